@@ -19,14 +19,21 @@ func (am *accessLogMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc
 	startTime := time.Now()
 	next(c)
 	duration := int64(time.Since(startTime) / time.Millisecond)
+	status := c.Writer.Status()
+	if code, ok := c.Get("status_code"); ok {
+		// the connection could be hijacked, so the writer doesn't know the status code
+		if statusCode, ok := code.(int); ok {
+			status = statusCode
+		}
+	}
 	accessLog := newGelfMessage(_app.hostname, _app.name, "access", 6)
 	accessLog.CustomFields["request_id"] = c.MustGet("request-id").(string)
-	accessLog.ShortMessage = fmt.Sprintf("%s %s [%d] %dms", c.Request.Method, c.Request.URL.Path, c.Writer.Status(), duration)
+	accessLog.ShortMessage = fmt.Sprintf("%s %s [%d] %dms", c.Request.Method, c.Request.URL.Path, status, duration)
 	accessLog.CustomFields["request_host"] = c.Request.Host
 	accessLog.CustomFields["path"] = c.Request.URL.Path
-	accessLog.CustomFields["status"] = c.Writer.Status()
+	accessLog.CustomFields["status"] = status
 	accessLog.CustomFields["content_length"] = c.Writer.ContentLength()
-	accessLog.CustomFields["client_ip"] = getClientIP(c.RemoteIPAddress())
+	accessLog.CustomFields["client_ip"] = getClientIP(c.Request)
 	accessLog.CustomFields["user_agent"] = c.RequestHeader("User-Agent")
 	accessLog.CustomFields["duration"] = duration
 
@@ -37,8 +44,29 @@ func (am *accessLogMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc
 		}
 	}
 
-	if !(c.Writer.Status() >= 200 && c.Writer.Status() < 400) {
-		requestDump, _ := httputil.DumpRequest(c.Request, true)
+	if decision, ok := c.Get("ip_restriction"); ok {
+		accessLog.CustomFields["ip_restriction"] = decision
+	}
+
+	if grpcStatus, ok := c.Get("grpc_status"); ok {
+		accessLog.CustomFields["grpc_status"] = grpcStatus
+	}
+
+	if service, ok := c.Get("service"); ok {
+		accessLog.CustomFields["service"] = service
+	}
+
+	if cache, ok := c.Get("cache"); ok {
+		accessLog.CustomFields["cache"] = cache
+	}
+
+	if upgrade, ok := c.Get("upgrade"); ok {
+		accessLog.CustomFields["upgrade"] = upgrade
+	}
+
+	if !(status >= 200 && status < 400) && status != 101 {
+		// the body isn't dumped, it may be large or already read by upstream
+		requestDump, _ := httputil.DumpRequest(c.Request, false)
 		respMsg, _ := c.Get("error")
 		if respMsg != nil {
 			respMessage := respMsg.(string)
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	redis "gopkg.in/redis.v4"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	apiKeyPrefixLength = 8
+	// lastUsedInterval avoids writing storage on every request.
+	lastUsedInterval = 1 * time.Minute
+)
+
+type apiKeyCollection struct {
+	Count   int       `json:"count"`
+	APIKeys []*APIKey `json:"api_keys"`
+}
+
+// APIKey is a long-lived credential of consumer, only the hash of the key is stored.
+type APIKey struct {
+	ID         string     `json:"id" bson:"_id"`
+	ConsumerID string     `json:"consumer_id" bson:"consumer_id"`
+	Name       string     `json:"name" bson:"name"`
+	Scopes     []string   `json:"scopes" bson:"scopes"`
+	Prefix     string     `json:"prefix" bson:"prefix"`
+	Hash       string     `json:"-" bson:"hash"`
+	Key        string     `json:"key,omitempty" bson:"-"` // plain key which is only returned when it was created
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+}
+
+func newAPIKey(consumerID string) *APIKey {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	panicIf(err)
+	key := base64.RawURLEncoding.EncodeToString(buf)
+
+	return &APIKey{
+		ID:         uuid.NewV4().String(),
+		ConsumerID: consumerID,
+		Prefix:     key[:apiKeyPrefixLength],
+		Hash:       hashAPIKey(key),
+		Key:        key,
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *APIKey) shouldTouch(now time.Time) bool {
+	return k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= lastUsedInterval
+}
+
+type APIKeyRepository interface {
+	Get(id string) (*APIKey, error)
+	GetByHash(hash string) (*APIKey, error)
+	GetByConsumerID(consumerID string) ([]*APIKey, error)
+	Insert(key *APIKey) error
+	UpdateLastUsed(id string, lastUsedAt time.Time) error
+	Delete(id string) error
+	DeleteByConsumerID(consumerID string) error
+}
+
+type APIKeyMemStore struct {
+	sync.RWMutex
+	data map[string]*APIKey
+}
+
+func newAPIKeyMemStore() *APIKeyMemStore {
+	return &APIKeyMemStore{
+		data: map[string]*APIKey{},
+	}
+}
+
+// copyAPIKey returns a copy without the plain key, so callers can't change the stored one.
+func copyAPIKey(key *APIKey) *APIKey {
+	if key == nil {
+		return nil
+	}
+	result := *key
+	result.Key = ""
+	return &result
+}
+
+func (ks *APIKeyMemStore) Get(id string) (*APIKey, error) {
+	ks.RLock()
+	defer ks.RUnlock()
+	result := copyAPIKey(ks.data[id])
+	return result, nil
+}
+
+func (ks *APIKeyMemStore) GetByHash(hash string) (*APIKey, error) {
+	ks.RLock()
+	defer ks.RUnlock()
+	for _, key := range ks.data {
+		if key.Hash == hash {
+			return copyAPIKey(key), nil
+		}
+	}
+	return nil, nil
+}
+
+func (ks *APIKeyMemStore) GetByConsumerID(consumerID string) ([]*APIKey, error) {
+	result := []*APIKey{}
+	ks.RLock()
+	defer ks.RUnlock()
+	for _, key := range ks.data {
+		if key.ConsumerID == consumerID {
+			result = append(result, copyAPIKey(key))
+		}
+	}
+	return result, nil
+}
+
+func (ks *APIKeyMemStore) Insert(key *APIKey) error {
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.data[key.ID] != nil {
+		return AppError{ErrorCode: "invalid_input", Message: "The api key already exits."}
+	}
+	ks.data[key.ID] = copyAPIKey(key)
+	return nil
+}
+
+func (ks *APIKeyMemStore) UpdateLastUsed(id string, lastUsedAt time.Time) error {
+	ks.Lock()
+	defer ks.Unlock()
+	key := ks.data[id]
+	if key != nil {
+		updated := *key
+		updated.LastUsedAt = &lastUsedAt
+		ks.data[id] = &updated
+	}
+	return nil
+}
+
+func (ks *APIKeyMemStore) Delete(id string) error {
+	ks.Lock()
+	defer ks.Unlock()
+	delete(ks.data, id)
+	return nil
+}
+
+func (ks *APIKeyMemStore) DeleteByConsumerID(consumerID string) error {
+	ks.Lock()
+	defer ks.Unlock()
+	for _, key := range ks.data {
+		if key.ConsumerID == consumerID {
+			delete(ks.data, key.ID)
+		}
+	}
+	return nil
+}
+
+/*********************
+	Mongo Database
+*********************/
+
+type apiKeyMongo struct {
+	connectionString string
+}
+
+func newAPIKeyMongo(connectionString string) (*apiKeyMongo, error) {
+	session, err := mgo.Dial(connectionString)
+	if err != nil {
+		panic(err)
+	}
+	defer session.Close()
+	c := session.DB("bifrost").C("api_keys")
+
+	// create index
+	hashIdx := mgo.Index{
+		Name:       "api_key_hash_idx",
+		Key:        []string{"hash"},
+		Unique:     true,
+		Background: true,
+	}
+	err = c.EnsureIndex(hashIdx)
+	if err != nil {
+		return nil, err
+	}
+	consumerIdx := mgo.Index{
+		Name:       "api_key_consumer_idx",
+		Key:        []string{"consumer_id"},
+		Background: true,
+	}
+	err = c.EnsureIndex(consumerIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiKeyMongo{
+		connectionString: connectionString,
+	}, nil
+}
+
+func (km *apiKeyMongo) newSession() (*mgo.Session, error) {
+	return mgo.Dial(km.connectionString)
+}
+
+func (km *apiKeyMongo) findOne(query bson.M) (*APIKey, error) {
+	session, err := km.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("api_keys")
+	key := APIKey{}
+	err = c.Find(query).One(&key)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (km *apiKeyMongo) Get(id string) (*APIKey, error) {
+	return km.findOne(bson.M{"_id": id})
+}
+
+func (km *apiKeyMongo) GetByHash(hash string) (*APIKey, error) {
+	return km.findOne(bson.M{"hash": hash})
+}
+
+func (km *apiKeyMongo) GetByConsumerID(consumerID string) ([]*APIKey, error) {
+	session, err := km.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("api_keys")
+	keys := []*APIKey{}
+	err = c.Find(bson.M{"consumer_id": consumerID}).All(&keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (km *apiKeyMongo) Insert(key *APIKey) error {
+	session, err := km.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("api_keys")
+	err = c.Insert(key)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "E11000") {
+			return AppError{ErrorCode: "invalid_input", Message: "The api key already exits"}
+		}
+		return err
+	}
+	return nil
+}
+
+func (km *apiKeyMongo) UpdateLastUsed(id string, lastUsedAt time.Time) error {
+	session, err := km.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("api_keys")
+	colQuerier := bson.M{"_id": id}
+	err = c.Update(colQuerier, bson.M{"$set": bson.M{"last_used_at": lastUsedAt}})
+	if err != nil && err.Error() != "not found" {
+		return err
+	}
+	return nil
+}
+
+func (km *apiKeyMongo) Delete(id string) error {
+	session, err := km.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("api_keys")
+	colQuerier := bson.M{"_id": id}
+	err = c.Remove(colQuerier)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (km *apiKeyMongo) DeleteByConsumerID(consumerID string) error {
+	session, err := km.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("api_keys")
+	colQuerier := bson.M{"consumer_id": consumerID}
+	_, err = c.RemoveAll(colQuerier)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/*********************
+	Redis Database
+*********************/
+
+type apiKeyRedis struct {
+	client *redis.Client
+}
+
+// apiKeyRedisValue keeps the hash which is hidden from json of APIKey.
+type apiKeyRedisValue struct {
+	*APIKey
+	Hash string `json:"hash"`
+}
+
+// newAPIKeyRedisValue returns the stored value of the api key, the plain key is never stored.
+func newAPIKeyRedisValue(apiKey *APIKey) apiKeyRedisValue {
+	return apiKeyRedisValue{APIKey: copyAPIKey(apiKey), Hash: apiKey.Hash}
+}
+
+func newAPIKeyRedis(addr string, password string, db int) (*apiKeyRedis, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	apiKeyRedis := &apiKeyRedis{
+		client: client,
+	}
+	return apiKeyRedis, nil
+}
+
+func (source *apiKeyRedis) Get(id string) (*APIKey, error) {
+	key := "apikey:id:" + id
+	s, err := source.client.Get(key).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		panicIf(err)
+	}
+
+	value := apiKeyRedisValue{APIKey: &APIKey{}}
+	err = json.Unmarshal([]byte(s), &value)
+	panicIf(err)
+	value.APIKey.Hash = value.Hash
+	return value.APIKey, nil
+}
+
+func (source *apiKeyRedis) GetByHash(hash string) (*APIKey, error) {
+	key := "apikey:hash:" + hash
+	id, err := source.client.Get(key).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		panicIf(err)
+	}
+	return source.Get(id)
+}
+
+func (source *apiKeyRedis) GetByConsumerID(consumerID string) ([]*APIKey, error) {
+	key := "apikey:consumer:" + consumerID
+	ids, err := source.client.SMembers(key).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		panicIf(err)
+	}
+
+	result := []*APIKey{}
+	for _, id := range ids {
+		apiKey, err := source.Get(id)
+		panicIf(err)
+		if apiKey != nil {
+			result = append(result, apiKey)
+		}
+	}
+	return result, nil
+}
+
+func (source *apiKeyRedis) save(apiKey *APIKey) {
+	val, err := json.Marshal(newAPIKeyRedisValue(apiKey))
+	panicIf(err)
+	key := "apikey:id:" + apiKey.ID
+	err = source.client.Set(key, val, 0).Err()
+	panicIf(err)
+}
+
+func (source *apiKeyRedis) Insert(apiKey *APIKey) error {
+	// check the key if exists
+	key := "apikey:id:" + apiKey.ID
+	exists, err := source.client.Exists(key).Result()
+	panicIf(err)
+	if exists {
+		return AppError{ErrorCode: "invalid_input", Message: "The api key already exits"}
+	}
+
+	// insert for apikey:id
+	source.save(apiKey)
+
+	// insert for apikey:hash
+	key = "apikey:hash:" + apiKey.Hash
+	err = source.client.Set(key, apiKey.ID, 0).Err()
+	panicIf(err)
+
+	// insert for apikey:consumer
+	key = "apikey:consumer:" + apiKey.ConsumerID
+	err = source.client.SAdd(key, apiKey.ID).Err()
+	panicIf(err)
+	return nil
+}
+
+func (source *apiKeyRedis) UpdateLastUsed(id string, lastUsedAt time.Time) error {
+	apiKey, err := source.Get(id)
+	panicIf(err)
+	if apiKey == nil {
+		return nil
+	}
+	apiKey.LastUsedAt = &lastUsedAt
+	source.save(apiKey)
+	return nil
+}
+
+func (source *apiKeyRedis) Delete(id string) error {
+	apiKey, err := source.Get(id)
+	panicIf(err)
+	if apiKey == nil {
+		return nil
+	}
+
+	err = source.client.Del("apikey:id:"+id, "apikey:hash:"+apiKey.Hash).Err()
+	panicIf(err)
+	err = source.client.SRem("apikey:consumer:"+apiKey.ConsumerID, id).Err()
+	panicIf(err)
+	return nil
+}
+
+func (source *apiKeyRedis) DeleteByConsumerID(consumerID string) error {
+	key := "apikey:consumer:" + consumerID
+	ids, err := source.client.SMembers(key).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil
+		}
+		panicIf(err)
+	}
+
+	for _, id := range ids {
+		err := source.Delete(id)
+		panicIf(err)
+	}
+
+	// delete apikey:consumer
+	err = source.client.Del(key).Err()
+	panicIf(err)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashAPIKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, tt := range tests {
+		if got := hashAPIKey(tt.key); got != tt.want {
+			t.Errorf("hashAPIKey(%q) = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestNewAPIKey(t *testing.T) {
+	apiKey := newAPIKey("c1")
+	if apiKey.ConsumerID != "c1" {
+		t.Errorf("consumer id = %s, want c1", apiKey.ConsumerID)
+	}
+	if len(apiKey.Key) != 43 {
+		t.Errorf("key length = %d, want 43", len(apiKey.Key))
+	}
+	if apiKey.Prefix != apiKey.Key[:apiKeyPrefixLength] {
+		t.Errorf("prefix = %s, want %s", apiKey.Prefix, apiKey.Key[:apiKeyPrefixLength])
+	}
+	if apiKey.Hash != hashAPIKey(apiKey.Key) {
+		t.Error("hash doesn't match the key")
+	}
+	if other := newAPIKey("c1"); other.Key == apiKey.Key || other.ID == apiKey.ID {
+		t.Error("keys must be unique")
+	}
+}
+
+func TestAPIKeyMemStore(t *testing.T) {
+	store := newAPIKeyMemStore()
+	apiKey := newAPIKey("c1")
+	if err := store.Insert(apiKey); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key   string
+		found bool
+	}{
+		{apiKey.Key, true},
+		{apiKey.Prefix, false},
+		{apiKey.Hash, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		got, err := store.GetByHash(hashAPIKey(tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got != nil) != tt.found {
+			t.Errorf("GetByHash(hash of %q) found = %v, want %v", tt.key, got != nil, tt.found)
+			continue
+		}
+		if got != nil && (got.ID != apiKey.ID || len(got.Key) > 0) {
+			t.Errorf("got %+v, want id %s without the plain key", got, apiKey.ID)
+		}
+	}
+}
+
+func TestAPIKeyRedisValue(t *testing.T) {
+	apiKey := newAPIKey("c1")
+	data, err := json.Marshal(newAPIKeyRedisValue(apiKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), apiKey.Key) {
+		t.Errorf("stored value contains the plain key: %s", data)
+	}
+	if len(apiKey.Key) == 0 {
+		t.Error("the plain key of the caller was cleared")
+	}
+
+	value := apiKeyRedisValue{APIKey: &APIKey{}}
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatal(err)
+	}
+	if value.Hash != apiKey.Hash || len(value.Key) > 0 {
+		t.Errorf("got hash %q and key %q, want hash %q without the key", value.Hash, value.Key, apiKey.Hash)
+	}
+}
+
+func TestAPIKeyShouldTouch(t *testing.T) {
+	now := time.Now()
+	recently := now.Add(-lastUsedInterval / 2)
+	long := now.Add(-lastUsedInterval)
+	tests := []struct {
+		lastUsedAt *time.Time
+		want       bool
+	}{
+		{nil, true},
+		{&recently, false},
+		{&long, true},
+	}
+	for _, tt := range tests {
+		apiKey := &APIKey{LastUsedAt: tt.lastUsedAt}
+		if got := apiKey.shouldTouch(now); got != tt.want {
+			t.Errorf("last used at %v: got %v, want %v", tt.lastUsedAt, got, tt.want)
+		}
+	}
+}
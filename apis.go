@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
@@ -14,11 +15,6 @@ import (
 	redis "gopkg.in/redis.v4"
 )
 
-type policy struct {
-	Allow string `json:"allow,omitempty" bson:"allow,omitempty"`
-	Deny  string `json:"deny,omitempty" bson:"deny,omitempty"`
-}
-
 type apiCollection struct {
 	Count int    `json:"count"`
 	APIs  []*api `json:"apis"`
@@ -53,99 +49,191 @@ func (source ByAPIWeight) Less(i, j int) bool {
 
 type api struct {
 	sync.RWMutex     `json:"-" bson:"-"`
-	ID               string    `json:"id" bson:"_id"`
-	Name             string    `json:"name" bson:"name"`
-	RequestHost      string    `json:"request_host" bson:"request_host"`
-	RequestPath      string    `json:"request_path" bson:"request_path"`
-	StripRequestPath bool      `json:"strip_request_path" bson:"strip_request_path"`
-	TargetURL        string    `json:"target_url" bson:"target_url"`
-	Redirect         bool      `json:"redirect" bson:"redirect"`
-	Authorization    bool      `json:"authorization" bson:"authorization"`
-	Whitelist        []string  `json:"whitelist" bson:"whitelist"`
-	Service          string    `json:"service" bson:"service"`
-	Weight           int       `json:"weight" bson:"weight"`
-	CreatedAt        time.Time `json:"created_at" bson:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at" bson:"updated_at"`
+	ID               string                 `json:"id" bson:"_id"`
+	Name             string                 `json:"name" bson:"name"`
+	RequestHost      string                 `json:"request_host" bson:"request_host"`
+	RequestPath      string                 `json:"request_path" bson:"request_path"`
+	Methods          []string               `json:"methods,omitempty" bson:"methods,omitempty"`
+	StripRequestPath bool                   `json:"strip_request_path" bson:"strip_request_path"`
+	TargetURL        string                 `json:"target_url" bson:"target_url"`
+	UpstreamPath     string                 `json:"upstream_path,omitempty" bson:"upstream_path,omitempty"`
+	Redirect         bool                   `json:"redirect" bson:"redirect"`
+	Authorization    bool                   `json:"authorization" bson:"authorization"`
+	Whitelist        []string               `json:"whitelist" bson:"whitelist"`
+	Service          string                 `json:"service" bson:"service"`
+	Retry            *retryPolicy           `json:"retry,omitempty" bson:"retry,omitempty"`
+	Timeouts         *TimeoutSetting        `json:"timeouts,omitempty" bson:"timeouts,omitempty"`
+	RateLimits       []*rateLimit           `json:"rate_limits,omitempty" bson:"rate_limits,omitempty"`
+	Headers          *headerTransform       `json:"headers,omitempty" bson:"headers,omitempty"`
+	Rewrite          *urlRewrite            `json:"rewrite,omitempty" bson:"rewrite,omitempty"`
+	Authentication   *authentication        `json:"authentication,omitempty" bson:"authentication,omitempty"`
+	Policies         []*policy              `json:"policies,omitempty" bson:"policies,omitempty"`
+	PolicyMode       string                 `json:"policy_mode,omitempty" bson:"policy_mode,omitempty"`
+	IPRestriction    *IPRestrictionSetting  `json:"ip_restriction,omitempty" bson:"ip_restriction,omitempty"`
+	Cache            *responseCache         `json:"cache,omitempty" bson:"cache,omitempty"`
+	Limits           *LimitSetting          `json:"limits,omitempty" bson:"limits,omitempty"`
+	RequestSchema    map[string]interface{} `json:"request_schema,omitempty" bson:"request_schema,omitempty"`
+	TrafficSplit     *trafficSplit          `json:"traffic_split,omitempty" bson:"traffic_split,omitempty"`
+	Protocol         string                 `json:"protocol,omitempty" bson:"protocol,omitempty"`
+	Mirror           *mirror                `json:"mirror,omitempty" bson:"mirror,omitempty"`
+	Weight           int                    `json:"weight" bson:"weight"`
+	CreatedAt        time.Time              `json:"created_at" bson:"created_at"`
+	UpdatedAt        time.Time              `json:"updated_at" bson:"updated_at"`
+	schema           *jsonSchema
 }
 
 func (a *api) switchSource(b *api) {
 	// swith
 	originalTarget := a.TargetURL
 	originalService := a.Service
+	originalTrafficSplit := a.TrafficSplit
 	a.TargetURL = b.TargetURL
 	b.TargetURL = originalTarget
 	a.Service = b.Service
 	b.Service = originalService
+	a.TrafficSplit = b.TrafficSplit
+	b.TrafficSplit = originalTrafficSplit
 }
 
-func (*api) isValid() bool {
-	return true
-}
-
-func (a api) isAllow(consumer Consumer) bool {
-	if a.Authorization == true && consumer.isAuthenticated() == false {
-		return false
+func (a *api) isValid() error {
+	if len(a.Name) == 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "name field can't be empty or null"}
 	}
-	if len(a.Whitelist) == 0 {
-		return true
+	_, err := newPathMatcher(a.RequestPath)
+	if err != nil {
+		return AppError{ErrorCode: "invalid_input", Message: "request_path field is invalid: " + err.Error()}
 	}
-	if len(consumer.Roles) == 0 {
-		return false
+	for i, method := range a.Methods {
+		a.Methods[i] = strings.ToUpper(method)
 	}
-	for _, role := range consumer.Roles {
-		if contains(a.Whitelist, role) {
-			return true
+	if !isValidProtocol(a.Protocol) {
+		return AppError{ErrorCode: "invalid_input", Message: "protocol field must be http1, h2 or h2c"}
+	}
+	if a.Retry != nil {
+		err := a.Retry.isValid()
+		if err != nil {
+			return err
 		}
 	}
-	return false
-	/*
-		for _, policy := range a.Policies {
-			if policy.isAllowPolicy() == false {
-				if policy.isMatch("deny", consumer) {
-					return false
-				}
-			} else {
-				if policy.isMatch("allow", consumer) {
-					return true
-				}
-			}
+	if a.Timeouts != nil {
+		err := a.Timeouts.isValid()
+		if err != nil {
+			return err
 		}
-		// if there isn't any policies, return true
-		return true
-	*/
+	}
+	for _, rl := range a.RateLimits {
+		err := rl.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Headers != nil {
+		err := a.Headers.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Rewrite != nil {
+		err := a.Rewrite.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Authentication != nil {
+		err := a.Authentication.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range a.Policies {
+		err := p.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	switch a.PolicyMode {
+	case "":
+		a.PolicyMode = policyModeEnforce
+	case policyModeEnforce, policyModeAudit:
+	default:
+		return AppError{ErrorCode: "invalid_input", Message: "policy_mode must be enforce or audit"}
+	}
+	if a.IPRestriction != nil {
+		err := a.IPRestriction.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Cache != nil {
+		err := a.Cache.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Limits != nil {
+		err := a.Limits.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if a.TrafficSplit != nil {
+		err := a.TrafficSplit.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if a.Mirror != nil {
+		err := a.Mirror.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if len(a.RequestSchema) > 0 {
+		schema, err := newJSONSchema(a.RequestSchema)
+		if err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "request_schema is invalid: " + err.Error()}
+		}
+		a.schema = schema
+	}
+	return nil
 }
 
-/*
-func (p policy) isAllowPolicy() bool {
-	if len(p.Allow) > 0 {
-		return true
+// checkServices returns an error when a service which the api entry refers to doesn't exist.  It is only checked
+// by admin api, isValid doesn't depend on the services which are loaded at the time.
+func (a *api) checkServices() error {
+	table := currentRoutes()
+	if a.TrafficSplit != nil {
+		err := a.TrafficSplit.checkServices(table)
+		if err != nil {
+			return err
+		}
 	}
-	return false
+	if a.Mirror != nil && len(a.Mirror.Service) > 0 && table.service(a.Mirror.Service) == nil {
+		return AppError{ErrorCode: "invalid_input", Message: "service of mirror was not found: " + a.Mirror.Service}
+	}
+	return nil
 }
 
-func (p policy) isMatch(kind string, consumer Consumer) bool {
-	var rule string
-	if kind == "deny" {
-		rule = strings.ToLower(p.Deny)
+func (a *api) isAllow(consumer Consumer, req *http.Request) bool {
+	if a.Authorization == true && consumer.isAuthenticated() == false {
+		return false
 	}
-
-	if kind == "allow" {
-		rule = strings.ToLower(p.Allow)
+	if !a.checkPolicies(consumer, req) {
+		return false
 	}
-
-	if rule == "all" {
+	if len(a.Whitelist) == 0 {
 		return true
 	}
-	terms := strings.Split(rule, ":")
-	if terms[0] == "g" {
-		for _, group := range consumer.Groups {
-			if group == terms[1] {
-				return true
-			}
+	if len(consumer.Roles) == 0 {
+		return false
+	}
+	for _, role := range consumer.Roles {
+		if contains(a.Whitelist, role) {
+			return true
 		}
 	}
 	return false
-}*/
+}
 
 type APIRepository interface {
 	Get(id string) (*api, error)
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+const (
+	authToken  = "token"
+	authAPIKey = "api_key"
+	authBasic  = "basic"
+	authHMAC   = "hmac"
+
+	hmacScheme           = "hmac"
+	defaultHMACClockSkew = 300 // seconds
+	maxHMACBodySize      = 10 * 1024 * 1024
+
+	passwordIterations = 10000
+)
+
+// dummyPasswordHash is verified when the consumer isn't found, it takes as long as the hash of a real password.
+var dummyPasswordHash = hashPassword("")
+
+// defaultAuthentication is used by the api entries without authentication section, it is the original behaviour.
+var defaultAuthentication = &authentication{
+	Plugins: []string{authToken, authAPIKey},
+}
+
+// authentication is the plugin chain which identifies consumers of an api entry.
+type authentication struct {
+	// Plugins are tried in order: token, api_key, basic and hmac.
+	Plugins []string `json:"plugins" bson:"plugins"`
+	// App is used to find consumers by username for basic and hmac, consumer id is expected when it is empty.
+	App string `json:"app,omitempty" bson:"app,omitempty"`
+	// ClockSkew is the allowed difference in seconds between Date header of hmac and bifrost.
+	ClockSkew int64 `json:"clock_skew,omitempty" bson:"clock_skew,omitempty"`
+}
+
+func (a *authentication) isValid() error {
+	if len(a.Plugins) == 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "plugins of authentication can't be empty"}
+	}
+	for _, plugin := range a.Plugins {
+		if _, ok := _authenticators[plugin]; !ok {
+			return AppError{ErrorCode: "invalid_input", Message: "authentication plugin is invalid: " + plugin}
+		}
+	}
+	if a.ClockSkew < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "clock_skew of authentication can't be negative"}
+	}
+	if a.ClockSkew == 0 {
+		a.ClockSkew = defaultHMACClockSkew
+	}
+	return nil
+}
+
+// findConsumer returns the consumer of basic and hmac credentials.
+func (a *authentication) findConsumer(name string) *Consumer {
+	var consumer *Consumer
+	var err error
+	if len(a.App) > 0 {
+		consumer, err = _consumerRepo.GetByUsername(a.App, name)
+	} else {
+		consumer, err = _consumerRepo.Get(name)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return consumer
+}
+
+func basicAuthenticator(c *napnap.Context, auth *authentication) (Consumer, bool) {
+	username, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return Consumer{}, false
+	}
+
+	consumer := auth.findConsumer(username)
+	if consumer == nil || len(consumer.PasswordHash) == 0 {
+		// the password is verified anyway, so the response time doesn't tell whether the username exists
+		verifyPassword(dummyPasswordHash, password)
+		_logger.debug("consumer was not found")
+		return Consumer{}, false
+	}
+	if !verifyPassword(consumer.PasswordHash, password) {
+		_logger.debug("password was invalid")
+		return Consumer{}, false
+	}
+
+	// the credential must not be sent to upstream
+	c.Request.Header.Del("Authorization")
+	return *consumer, true
+}
+
+// hmacAuthenticator verifies the request signature which is sent as
+//
+//	Authorization: hmac username="alice", algorithm="hmac-sha256", headers="date request-line digest", signature="..."
+//
+// The signing string is the listed headers, one "name: value" per line, "request-line" is
+// "METHOD /path?query HTTP/1.1".  The version is always HTTP/1.1, so the signature doesn't depend on the protocol
+// which the client and proxies negotiate, e.g. h2.  Date must be signed and Digest must be signed when the request
+// has body.
+func hmacAuthenticator(c *napnap.Context, auth *authentication) (Consumer, bool) {
+	value := c.Request.Header.Get("Authorization")
+	if !strings.HasPrefix(value, hmacScheme+" ") {
+		return Consumer{}, false
+	}
+	params := parseAuthParams(value[len(hmacScheme)+1:])
+
+	var newHash func() hash.Hash
+	switch params["algorithm"] {
+	case "hmac-sha256":
+		newHash = sha256.New
+	case "hmac-sha512":
+		newHash = sha512.New
+	default:
+		_logger.debug("hmac algorithm was invalid")
+		return Consumer{}, false
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	if !contains(headers, "date") {
+		_logger.debug("date header was not signed")
+		return Consumer{}, false
+	}
+
+	// the request must be sent within the clock skew
+	clockSkew := auth.ClockSkew
+	if clockSkew <= 0 {
+		clockSkew = defaultHMACClockSkew
+	}
+	date, err := http.ParseTime(c.Request.Header.Get("Date"))
+	if err != nil {
+		_logger.debug("date header was invalid")
+		return Consumer{}, false
+	}
+	if skew := time.Since(date); skew > time.Duration(clockSkew)*time.Second || skew < -time.Duration(clockSkew)*time.Second {
+		_logger.debug("date header was out of clock skew")
+		return Consumer{}, false
+	}
+
+	if !verifyDigest(c.Request, contains(headers, "digest")) {
+		_logger.debug("digest was invalid")
+		return Consumer{}, false
+	}
+
+	consumer := auth.findConsumer(params["username"])
+	if consumer == nil || len(consumer.HMACSecret) == 0 {
+		_logger.debug("consumer was not found")
+		return Consumer{}, false
+	}
+
+	lines := []string{}
+	for _, name := range headers {
+		if name == "request-line" {
+			lines = append(lines, c.Request.Method+" "+c.Request.URL.RequestURI()+" HTTP/1.1")
+			continue
+		}
+		lines = append(lines, name+": "+c.Request.Header.Get(name))
+	}
+	mac := hmac.New(newHash, []byte(consumer.HMACSecret))
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		_logger.debug("hmac signature was invalid")
+		return Consumer{}, false
+	}
+
+	c.Request.Header.Del("Authorization")
+	return *consumer, true
+}
+
+// verifyDigest checks Digest header against the request body, the body is restored after reading.
+func verifyDigest(req *http.Request, isSigned bool) bool {
+	digest := req.Header.Get("Digest")
+	hasBody := req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+	if !hasBody && len(digest) == 0 {
+		return true
+	}
+	if !isSigned || !strings.HasPrefix(digest, "SHA-256=") {
+		return false
+	}
+
+	var body []byte
+	if hasBody {
+		var err error
+		body, err = ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, maxHMACBodySize))
+		req.Body.Close()
+		if err != nil {
+			return false
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256(body)
+	return digest[len("SHA-256="):] == base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parseAuthParams parses the comma separated key="value" pairs of Authorization header.
+func parseAuthParams(s string) map[string]string {
+	result := map[string]string{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value = s[1 : end+1]
+			s = s[end+2:]
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// hashPassword returns "pbkdf2-sha256$iterations$salt$hash" of the password.
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	panicIf(err)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	panicIf(err)
+	return "pbkdf2-sha256$" + strconv.Itoa(passwordIterations) + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+}
+
+func verifyPassword(passwordHash string, password string) bool {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 of "password" and "salt" with 1 iteration
+	known := "pbkdf2-sha256$1$" + base64.RawStdEncoding.EncodeToString([]byte("salt")) + "$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs"
+	hash := hashPassword("secret")
+
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{known, "password", true},
+		{known, "Password", false},
+		{hash, "secret", true},
+		{hash, "secret ", false},
+		{hash, "", false},
+		{"", "", false},
+		{"bcrypt$10$salt$hash", "secret", false},
+		{"pbkdf2-sha256$0$c2FsdA$EgtrbP", "password", false},
+	}
+	for _, tt := range tests {
+		if got := verifyPassword(tt.hash, tt.password); got != tt.want {
+			t.Errorf("%s with %q: got %v, want %v", tt.hash, tt.password, got, tt.want)
+		}
+	}
+	if hashPassword("secret") == hash {
+		t.Error("the salt must be random")
+	}
+}
+
+func signHMAC(secret string, lines ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthenticationPlugins(t *testing.T) {
+	_config = newConfiguration()
+	_consumerRepo = newConsumerMemStore()
+	alice := &Consumer{App: "web", Username: "alice", PasswordHash: hashPassword("secret"), HMACSecret: "hmac-secret"}
+	bob := &Consumer{App: "web", Username: "bob", HMACSecret: "bob-secret"}
+	for _, consumer := range []*Consumer{alice, bob} {
+		if err := _consumerRepo.Insert(consumer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auth := &authentication{Plugins: []string{authBasic, authHMAC}, App: "web", ClockSkew: defaultHMACClockSkew}
+	setupTestRoutes(t, nil, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/", Authentication: auth},
+	})
+	whoami := func(c *napnap.Context, next napnap.HandlerFunc) {
+		consumer := c.MustGet("consumer").(Consumer)
+		// the credentials must not reach upstream
+		if len(c.Request.Header.Get("Authorization")) > 0 && consumer.isAuthenticated() {
+			c.String(500, "authorization was kept")
+			return
+		}
+		c.String(200, consumer.Username)
+	}
+	gateway := newTestGateway(t, Consumer{}, identity, whoami)
+
+	date := time.Now().UTC().Format(http.TimeFormat)
+	hmacAuth := func(username, secret, headers string, lines ...string) string {
+		return `hmac username="` + username + `", algorithm="hmac-sha256", headers="` + headers + `", signature="` + signHMAC(secret, lines...) + `"`
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		date          string
+		want          string
+	}{
+		{"basic", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), "", "alice"},
+		{"basic with wrong password", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong")), "", ""},
+		{"basic of unknown user", "Basic " + base64.StdEncoding.EncodeToString([]byte("carol:")), "", ""},
+		{"basic without password hash", "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:")), "", ""},
+		{"hmac", hmacAuth("alice", "hmac-secret", "date", "date: "+date), date, "alice"},
+		{"hmac with request line", hmacAuth("bob", "bob-secret", "date request-line", "date: "+date, "GET /users?page=1 HTTP/1.1"), date, "bob"},
+		{"hmac of other secret", hmacAuth("alice", "bob-secret", "date", "date: "+date), date, ""},
+		{"hmac without date", hmacAuth("alice", "hmac-secret", "request-line", "GET /users?page=1 HTTP/1.1"), date, ""},
+		{"hmac out of clock skew", hmacAuth("alice", "hmac-secret", "date", "date: "+"Mon, 02 Jan 2006 15:04:05 GMT"), "Mon, 02 Jan 2006 15:04:05 GMT", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", gateway.URL+"/users?page=1", nil)
+		req.Header.Set("Authorization", tt.authorization)
+		if len(tt.date) > 0 {
+			req.Header.Set("Date", tt.date)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || string(body) != tt.want {
+			t.Errorf("%s: got %d %q, want %q", tt.name, resp.StatusCode, body, tt.want)
+		}
+	}
+}
+
+func TestHMACRequestLineOfHTTP2(t *testing.T) {
+	_config = newConfiguration()
+	_consumerRepo = newConsumerMemStore()
+	consumer := &Consumer{App: "web", Username: "alice", HMACSecret: "hmac-secret"}
+	if err := _consumerRepo.Insert(consumer); err != nil {
+		t.Fatal(err)
+	}
+	auth := &authentication{Plugins: []string{authHMAC}, App: "web"}
+
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req := httptest.NewRequest("GET", "http://example.com/users", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Header.Set("Date", date)
+	req.Header.Set("Authorization", `hmac username="alice", algorithm="hmac-sha256", headers="date request-line", signature="`+
+		signHMAC("hmac-secret", "date: "+date, "GET /users HTTP/1.1")+`"`)
+	c := napnap.NewContext(napnap.New(), req, nil)
+	if got, ok := hmacAuthenticator(c, auth); !ok || got.ID != consumer.ID {
+		t.Errorf("got %+v, %v, want the consumer of the signature with HTTP/1.1", got, ok)
+	}
+}
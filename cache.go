@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+	redis "gopkg.in/redis.v4"
+)
+
+const (
+	defaultCacheMaxBodySize = 1024 * 1024 // 1MB
+	// cacheRevalidateWindow is how long the stale responses with validators are kept for revalidation.
+	cacheRevalidateWindow = 1 * time.Hour
+
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheRevalidated = "revalidated"
+)
+
+// responseCache is the opt-in response cache of api entry.  Only GET requests are cached and upstream
+// Cache-Control, Expires and Vary headers are honoured.  Responses are shared by all consumers unless
+// PerConsumer is set, so api entries which return consumer data must turn it on.
+type responseCache struct {
+	// TTL is the freshness in seconds when upstream doesn't send Cache-Control or Expires.
+	TTL int `json:"ttl" bson:"ttl"`
+	// Headers are the request headers which are part of the cache key.
+	Headers     []string `json:"headers,omitempty" bson:"headers,omitempty"`
+	PerConsumer bool     `json:"per_consumer" bson:"per_consumer"`
+	MaxBodySize int64    `json:"max_body_size,omitempty" bson:"max_body_size,omitempty"`
+}
+
+func (rc *responseCache) isValid() error {
+	if rc.TTL < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "ttl of cache can't be negative"}
+	}
+	if rc.MaxBodySize < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "max_body_size of cache can't be negative"}
+	}
+	if rc.MaxBodySize == 0 {
+		rc.MaxBodySize = defaultCacheMaxBodySize
+	}
+	for i, name := range rc.Headers {
+		rc.Headers[i] = http.CanonicalHeaderKey(name)
+	}
+	return nil
+}
+
+// isCacheable reports whether the response of the request can be looked up and stored.
+func (rc *responseCache) isCacheable(req *http.Request) bool {
+	if req.Method != "GET" || isUpgradeRequest(req) {
+		return false
+	}
+	return !parseCacheControl(req.Header)["no-store"]
+}
+
+// key returns the cache key which starts with api id, so the responses of an api can be purged by prefix.
+// The service which serves the request is a part of the key, so the services of traffic split don't share
+// their responses.
+//
+//	<api id>:GET:<host><path>?<sorted query>|service=<service>|<header>=<value>|consumer=<consumer id>
+func (rc *responseCache) key(apiEntry *api, serviceName string, req *http.Request, consumer Consumer) string {
+	key := apiEntry.ID + ":" + req.Method + ":" + strings.ToLower(req.Host) + req.URL.Path
+	if query := req.URL.Query(); len(query) > 0 {
+		key += "?" + query.Encode()
+	}
+	if len(serviceName) > 0 {
+		key += "|service=" + serviceName
+	}
+	for _, name := range rc.Headers {
+		key += "|" + name + "=" + req.Header.Get(name)
+	}
+	if rc.PerConsumer {
+		key += "|consumer=" + consumer.ID
+	}
+	return key
+}
+
+// cachedResponse is the upstream response which is kept in cache repository.
+type cachedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	// Vary keeps the request values of the headers listed in upstream Vary header.
+	Vary      map[string]string `json:"vary,omitempty"`
+	StoredAt  time.Time         `json:"stored_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+func (cr *cachedResponse) isFresh(now time.Time) bool {
+	return now.Before(cr.ExpiresAt)
+}
+
+func (cr *cachedResponse) hasValidators() bool {
+	return len(cr.Header.Get("ETag")) > 0 || len(cr.Header.Get("Last-Modified")) > 0
+}
+
+// isVaryMatch reports whether the request sends the same values of Vary headers as the cached one.
+func (cr *cachedResponse) isVaryMatch(req *http.Request) bool {
+	for name, value := range cr.Vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// setValidators turns the upstream request into a conditional request.
+func (cr *cachedResponse) setValidators(header http.Header) {
+	header.Del("If-None-Match")
+	header.Del("If-Modified-Since")
+	if etag := cr.Header.Get("ETag"); len(etag) > 0 {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified := cr.Header.Get("Last-Modified"); len(lastModified) > 0 {
+		header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// revalidated returns a copy of the cached response which is refreshed by the 304 response of upstream.
+func (cr *cachedResponse) revalidated(header http.Header, rc *responseCache, now time.Time) *cachedResponse {
+	updated := *cr
+	updated.Header = http.Header{}
+	for k, vv := range cr.Header {
+		updated.Header[k] = vv
+	}
+	for _, name := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified"} {
+		if values, ok := header[name]; ok {
+			updated.Header[name] = values
+		}
+	}
+	ttl, _ := cacheFreshness(updated.Header, rc, now)
+	updated.StoredAt = now
+	updated.ExpiresAt = now.Add(ttl)
+	return &updated
+}
+
+// storeExpiration is how long the response is kept in repository, the stale responses with validators
+// are kept longer, so they can be revalidated.
+func (cr *cachedResponse) storeExpiration(now time.Time) time.Duration {
+	expiration := cr.ExpiresAt.Sub(now)
+	if cr.hasValidators() {
+		expiration += cacheRevalidateWindow
+	}
+	return expiration
+}
+
+// parseCacheControl returns the directives of Cache-Control header, Pragma: no-cache is treated as no-cache.
+func parseCacheControl(header http.Header) map[string]bool {
+	result := map[string]bool{}
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if idx := strings.Index(directive, "="); idx >= 0 {
+				directive = directive[:idx]
+			}
+			if len(directive) > 0 {
+				result[directive] = true
+			}
+		}
+	}
+	if strings.EqualFold(header.Get("Pragma"), "no-cache") {
+		result["no-cache"] = true
+	}
+	return result
+}
+
+// cacheControlSeconds returns the value of a directive like max-age=60.
+func cacheControlSeconds(header http.Header, directive string) (int, bool) {
+	for _, value := range header["Cache-Control"] {
+		for _, d := range strings.Split(value, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if !strings.HasPrefix(d, directive+"=") {
+				continue
+			}
+			seconds, err := strconv.Atoi(strings.Trim(d[len(directive)+1:], `"`))
+			if err != nil {
+				return 0, false
+			}
+			return seconds, true
+		}
+	}
+	return 0, false
+}
+
+// cacheFreshness returns how long the response is fresh and whether it can be stored.
+// s-maxage and max-age win over Expires, ttl of api entry is used when upstream sends none of them.
+func cacheFreshness(header http.Header, rc *responseCache, now time.Time) (time.Duration, bool) {
+	directives := parseCacheControl(header)
+	if directives["no-store"] {
+		return 0, false
+	}
+	if directives["private"] && !rc.PerConsumer {
+		return 0, false
+	}
+	if strings.TrimSpace(header.Get("Vary")) == "*" || len(header.Get("Set-Cookie")) > 0 {
+		return 0, false
+	}
+
+	var ttl time.Duration
+	if seconds, ok := cacheControlSeconds(header, "s-maxage"); ok {
+		ttl = time.Duration(seconds) * time.Second
+	} else if seconds, ok := cacheControlSeconds(header, "max-age"); ok {
+		ttl = time.Duration(seconds) * time.Second
+	} else if expires := header.Get("Expires"); len(expires) > 0 {
+		// invalid Expires like "0" means already expired
+		expiresAt, err := http.ParseTime(expires)
+		if err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			ttl = expiresAt.Sub(date)
+		}
+	} else {
+		ttl = time.Duration(rc.TTL) * time.Second
+	}
+
+	if directives["no-cache"] || ttl < 0 {
+		// the response must be revalidated before it is used
+		ttl = 0
+	}
+	if ttl == 0 && len(header.Get("ETag")) == 0 && len(header.Get("Last-Modified")) == 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// isNotModified reports whether the conditional request of client matches the response.
+func isNotModified(req *http.Request, header http.Header) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); len(ifNoneMatch) > 0 {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if len(etag) == 0 {
+			return false
+		}
+		for _, value := range strings.Split(ifNoneMatch, ",") {
+			value = strings.TrimSpace(value)
+			if value == "*" || strings.TrimPrefix(value, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+// lookupCache returns the cached response of the key, nil is returned when it doesn't match the request.
+func lookupCache(key string, req *http.Request) *cachedResponse {
+	cached, err := _cacheRepo.Get(key)
+	if err != nil {
+		// we don't fail the request when the cache is unavailable
+		_logger.errorf("cache error: %v", err)
+		return nil
+	}
+	if cached == nil || !cached.isVaryMatch(req) {
+		return nil
+	}
+	return cached
+}
+
+func storeCache(key string, cached *cachedResponse, now time.Time) {
+	err := _cacheRepo.Set(key, cached, cached.storeExpiration(now))
+	if err != nil {
+		_logger.errorf("cache error: %v", err)
+	}
+}
+
+// serveCache writes the cached response to client.
+func (p *proxy) serveCache(c *napnap.Context, cached *cachedResponse, route *routeMatch, consumer Consumer, status string) {
+	c.Set("cache", status)
+	header := c.Writer.Header()
+	p.copyHeader(header, cached.Header)
+	if route.api.Headers != nil {
+		route.api.Headers.Response.apply(header, newTemplateVars(c, consumer, route))
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(cached.StoredAt)/time.Second)))
+	header.Set("X-Cache", strings.ToUpper(status))
+
+	if isNotModified(c.Request, cached.Header) {
+		c.SetStatus(304)
+		return
+	}
+	if !_config.Gzip.Enable {
+		header.Set("Content-Length", strconv.Itoa(len(cached.Body)))
+	}
+	c.SetStatus(cached.StatusCode)
+	_, err := c.Writer.Write(cached.Body)
+	if err != nil {
+		_logger.debugf("write cached response failed: %v", err)
+	}
+}
+
+// cacheResponse stores the upstream response when it is cacheable and returns the body which is sent to client.
+// The response which is larger than max body size is streamed without storing.
+func (p *proxy) cacheResponse(c *napnap.Context, key string, rc *responseCache, resp *http.Response, respBody io.Reader) io.Reader {
+	if resp.StatusCode != 200 {
+		return respBody
+	}
+	now := time.Now()
+	ttl, ok := cacheFreshness(resp.Header, rc, now)
+	if !ok {
+		return respBody
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(respBody, rc.MaxBodySize+1))
+	if err != nil || int64(len(body)) > rc.MaxBodySize {
+		return io.MultiReader(bytes.NewReader(body), respBody)
+	}
+
+	cached := &cachedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     http.Header{},
+		Body:       body,
+		StoredAt:   now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	p.copyHeader(cached.Header, resp.Header)
+	for _, value := range resp.Header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if len(name) > 0 {
+				if cached.Vary == nil {
+					cached.Vary = map[string]string{}
+				}
+				cached.Vary[name] = c.Request.Header.Get(name)
+			}
+		}
+	}
+	storeCache(key, cached, now)
+
+	c.Set("cache", cacheMiss)
+	c.Writer.Header().Set("X-Cache", strings.ToUpper(cacheMiss))
+	return bytes.NewReader(body)
+}
+
+func purgeCacheEndpoint(c *napnap.Context) {
+	apiID := c.Query("api_id")
+	prefix := c.Query("prefix")
+	if len(apiID) == 0 && len(prefix) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "api_id or prefix can't be empty"})
+	}
+	if len(apiID) > 0 {
+		prefix = apiID + ":" + prefix
+	}
+	count, err := _cacheRepo.DeleteByPrefix(prefix)
+	panicIf(err)
+	_logger.infof("cache was purged: %s", prefix+" ("+strconv.Itoa(count)+" entries)")
+	c.SetStatus(204)
+}
+
+type CacheRepository interface {
+	Get(key string) (*cachedResponse, error)
+	Set(key string, cached *cachedResponse, expiration time.Duration) error
+	DeleteByPrefix(prefix string) (int, error)
+}
+
+/*********************
+	Memory
+*********************/
+
+type cacheItem struct {
+	key      string
+	cached   *cachedResponse
+	expireAt time.Time
+}
+
+// CacheMemStore is a LRU cache, the least recently used response is removed when it is full.
+type CacheMemStore struct {
+	sync.Mutex
+	maxEntries int
+	items      map[string]*list.Element
+	order      *list.List
+}
+
+func newCacheMemStore(maxEntries int) *CacheMemStore {
+	return &CacheMemStore{
+		maxEntries: maxEntries,
+		items:      map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+func (cs *CacheMemStore) Get(key string) (*cachedResponse, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	element, ok := cs.items[key]
+	if !ok {
+		return nil, nil
+	}
+	item := element.Value.(*cacheItem)
+	if time.Now().After(item.expireAt) {
+		cs.order.Remove(element)
+		delete(cs.items, key)
+		return nil, nil
+	}
+	cs.order.MoveToFront(element)
+	return item.cached, nil
+}
+
+func (cs *CacheMemStore) Set(key string, cached *cachedResponse, expiration time.Duration) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	item := &cacheItem{
+		key:      key,
+		cached:   cached,
+		expireAt: time.Now().Add(expiration),
+	}
+	if element, ok := cs.items[key]; ok {
+		element.Value = item
+		cs.order.MoveToFront(element)
+		return nil
+	}
+	cs.items[key] = cs.order.PushFront(item)
+	for cs.maxEntries > 0 && cs.order.Len() > cs.maxEntries {
+		oldest := cs.order.Back()
+		cs.order.Remove(oldest)
+		delete(cs.items, oldest.Value.(*cacheItem).key)
+	}
+	return nil
+}
+
+func (cs *CacheMemStore) DeleteByPrefix(prefix string) (int, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	count := 0
+	for key, element := range cs.items {
+		if strings.HasPrefix(key, prefix) {
+			cs.order.Remove(element)
+			delete(cs.items, key)
+			count++
+		}
+	}
+	return count, nil
+}
+
+/*********************
+	Redis Database
+*********************/
+
+type cacheRedis struct {
+	client *redis.Client
+}
+
+func newCacheRedis(addr string, password string, db int) (*cacheRedis, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	cacheRedis := &cacheRedis{
+		client: client,
+	}
+	return cacheRedis, nil
+}
+
+func (source *cacheRedis) Get(key string) (*cachedResponse, error) {
+	str, err := source.client.Get("cache:" + key).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cached cachedResponse
+	err = json.Unmarshal([]byte(str), &cached)
+	if err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+func (source *cacheRedis) Set(key string, cached *cachedResponse, expiration time.Duration) error {
+	buf, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	return source.client.Set("cache:"+key, buf, expiration).Err()
+}
+
+func (source *cacheRedis) DeleteByPrefix(prefix string) (int, error) {
+	count := 0
+	keys := []string{}
+	iter := source.client.Scan(0, "cache:"+escapeRedisPattern(prefix)+"*", 1000).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+		if len(keys) >= 1000 {
+			err := source.client.Del(keys...).Err()
+			if err != nil {
+				return count, err
+			}
+			count += len(keys)
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return count, err
+	}
+	if len(keys) > 0 {
+		err := source.client.Del(keys...).Err()
+		if err != nil {
+			return count, err
+		}
+		count += len(keys)
+	}
+	return count, nil
+}
+
+// escapeRedisPattern escapes the glob characters of SCAN MATCH.
+func escapeRedisPattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Now()
+	rc := &responseCache{TTL: 30}
+	tests := []struct {
+		header http.Header
+		want   time.Duration
+		wantOK bool
+	}{
+		{http.Header{}, 30 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=60"}}, 60 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 120 * time.Second, true},
+		{http.Header{"Expires": {now.Add(time.Minute).UTC().Format(http.TimeFormat)}, "Date": {now.UTC().Format(http.TimeFormat)}}, 60 * time.Second, true},
+		{http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, 0, true},
+		{http.Header{"Cache-Control": {"no-cache"}}, 0, false},
+		{http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{http.Header{"Vary": {"*"}}, 0, false},
+		{http.Header{"Set-Cookie": {"session=1"}}, 0, false},
+		{http.Header{"Expires": {"0"}}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := cacheFreshness(tt.header, rc, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%v: got %v, %v, want %v, %v", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	if _, ok := cacheFreshness(http.Header{"Cache-Control": {"private, max-age=60"}}, &responseCache{PerConsumer: true}, now); !ok {
+		t.Error("the private response isn't cached per consumer")
+	}
+}
+
+func TestProxyCache(t *testing.T) {
+	var requests, conditionals int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/items/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"f1"`)
+		case "/items/revalidated":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&conditionals, 1)
+				w.WriteHeader(304)
+				return
+			}
+		case "/items/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		io.WriteString(w, "response "+strconv.Itoa(int(count)))
+	}))
+	defer server.Close()
+
+	_config = newConfiguration()
+	_cacheRepo = newCacheMemStore(100)
+	apiEntry := &api{ID: "a1", Name: "items", RequestHost: "*", RequestPath: "/items", Service: "items", Cache: &responseCache{}}
+	if err := apiEntry.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "items", Upstreams: []*upstream{{Name: "u1", TargetURL: server.URL}}},
+	}, []*api{apiEntry})
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+	router := napnap.NewRouter()
+	router.Delete("/v1/cache", purgeCacheEndpoint)
+	admin := newTestAdmin(t, router)
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		header          http.Header
+		wantStatus      int
+		wantBody        string
+		wantCache       string
+		wantRequests    int32
+		wantConditional int32
+	}{
+		{"miss", "GET", "/items/fresh", nil, 200, "response 1", "MISS", 1, 0},
+		{"hit", "GET", "/items/fresh", nil, 200, "response 1", "HIT", 1, 0},
+		{"query is a part of key", "GET", "/items/fresh?page=2", nil, 200, "response 2", "MISS", 2, 0},
+		{"conditional request of client", "GET", "/items/fresh", http.Header{"If-None-Match": {`"f1"`}}, 304, "", "HIT", 2, 0},
+		{"post isn't cached", "POST", "/items/fresh", nil, 200, "response 3", "", 3, 0},
+		{"no-store of client", "GET", "/items/fresh", http.Header{"Cache-Control": {"no-store"}}, 200, "response 4", "", 4, 0},
+		{"stale response is stored", "GET", "/items/revalidated", nil, 200, "response 5", "MISS", 5, 0},
+		{"stale response is revalidated", "GET", "/items/revalidated", nil, 200, "response 5", "REVALIDATED", 6, 1},
+		{"private response", "GET", "/items/private", nil, 200, "response 7", "", 7, 1},
+		{"private response isn't shared", "GET", "/items/private", nil, 200, "response 8", "", 8, 1},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, gateway.URL+tt.path, nil)
+		for name, values := range tt.header {
+			req.Header[name] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus || string(body) != tt.wantBody || resp.Header.Get("X-Cache") != tt.wantCache {
+			t.Errorf("%s: got %d %q with X-Cache %q, want %d %q with %q", tt.name, resp.StatusCode, body, resp.Header.Get("X-Cache"),
+				tt.wantStatus, tt.wantBody, tt.wantCache)
+		}
+		if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+			t.Errorf("%s: upstream got %d requests, want %d", tt.name, got, tt.wantRequests)
+		}
+		if got := atomic.LoadInt32(&conditionals); got != tt.wantConditional {
+			t.Errorf("%s: upstream got %d conditional requests, want %d", tt.name, got, tt.wantConditional)
+		}
+	}
+
+	// the responses of api entry are purged by admin api
+	req, _ := http.NewRequest("DELETE", admin.URL+"/v1/cache?api_id=a1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Fatalf("purge: got %d, want 204", resp.StatusCode)
+	}
+	resp, err = http.Get(gateway.URL + "/items/fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("purged response: got X-Cache %q, want MISS", resp.Header.Get("X-Cache"))
+	}
+}
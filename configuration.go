@@ -1,8 +1,22 @@
 package main
 
-import "errors"
+import (
+	"errors"
+	"net"
+	"time"
+)
 
-var ErrDataAddr = errors.New("config: data address can't be empty")
+var (
+	ErrDataAddr       = errors.New("config: data address can't be empty")
+	ErrRateLimitStore = errors.New("config: rate limit store must be memory or redis")
+	ErrCacheStore     = errors.New("config: cache store must be memory or redis")
+	ErrTrustedProxies = errors.New("config: trusted proxies must be ip addresses or CIDR blocks")
+	ErrIPRestriction  = errors.New("config: ip restriction must be ip addresses or CIDR blocks")
+	ErrJWTAlgorithm   = errors.New("config: jwt algorithm must be HS256, RS256 or ES256")
+	ErrJWTKeys        = errors.New("config: jwt requires keys or jwks_file")
+	ErrJWTSigningKey  = errors.New("config: jwt signing key must be one of the keys")
+	ErrJWTSecret      = errors.New("config: jwt secret of HS256 must be at least 32 bytes")
+)
 
 type Header struct {
 	AddHeader string
@@ -14,6 +28,48 @@ type TokenSetting struct {
 	SlidingExpiration bool  `yaml:"sliding_expiration"`
 }
 
+// JWTSetting verifies signed JWTs which are sent instead of opaque tokens.
+type JWTSetting struct {
+	Enable   bool            `yaml:"enable"`
+	Issuer   string          `yaml:"issuer"`
+	Audience string          `yaml:"audience"`
+	Leeway   int64           `yaml:"leeway"` // seconds
+	Keys     []JWTKeySetting `yaml:"keys"`
+	JWKSFile string          `yaml:"jwks_file"`
+	Claims   JWTClaimSetting `yaml:"claims"`
+	// SigningKey is the id of the key which signs the tokens issued by token api.
+	SigningKey string `yaml:"signing_key"`
+}
+
+type JWTKeySetting struct {
+	ID             string `yaml:"id"`
+	Algorithm      string `yaml:"algorithm"` // HS256, RS256 or ES256
+	Secret         string `yaml:"secret"`
+	PublicKeyFile  string `yaml:"public_key_file"`
+	PrivateKeyFile string `yaml:"private_key_file"`
+}
+
+// JWTClaimSetting is the claim names which are mapped onto consumer.
+type JWTClaimSetting struct {
+	ConsumerID   string `yaml:"consumer_id"`
+	App          string `yaml:"app"`
+	Roles        string `yaml:"roles"`
+	CustomFields string `yaml:"custom_fields"`
+}
+
+// OAuthSetting is the oauth2 token endpoint of gateway, timeouts are seconds.
+type OAuthSetting struct {
+	Enable              bool  `yaml:"enable"`
+	AccessTokenTimeout  int64 `yaml:"access_token_timeout"`
+	RefreshTokenTimeout int64 `yaml:"refresh_token_timeout"`
+}
+
+// APIKeySetting is where the identity middleware finds api keys.
+type APIKeySetting struct {
+	Header     string `yaml:"header"`
+	QueryParam string `yaml:"query_param"`
+}
+
 type DataSetting struct {
 	Type             string `yaml:"type"`
 	ConnectionString string `yaml:"connection_string"`
@@ -22,6 +78,105 @@ type DataSetting struct {
 	DB               string `yaml:"db"`
 }
 
+// noTimeout disables the timeout, e.g. the request timeout of config file for the api entry of long polling.
+const noTimeout = -1
+
+// TimeoutSetting controls how bifrost talks to upstreams.  All durations are in milliseconds, zero means
+// the value is inherited from the service or config file and -1 means no timeout.
+type TimeoutSetting struct {
+	ConnectTimeout        int `yaml:"connect_timeout" json:"connect_timeout" bson:"connect_timeout"`
+	ResponseHeaderTimeout int `yaml:"response_header_timeout" json:"response_header_timeout" bson:"response_header_timeout"`
+	RequestTimeout        int `yaml:"request_timeout" json:"request_timeout" bson:"request_timeout"`
+	MaxIdleConnsPerHost   int `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host" bson:"max_idle_conns_per_host"`
+}
+
+func (ts *TimeoutSetting) isValid() error {
+	if ts.ConnectTimeout < noTimeout || ts.ResponseHeaderTimeout < noTimeout || ts.RequestTimeout < noTimeout {
+		return AppError{ErrorCode: "invalid_input", Message: "timeouts fields must be -1 or greater"}
+	}
+	if ts.MaxIdleConnsPerHost < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "max_idle_conns_per_host field can't be negative"}
+	}
+	return nil
+}
+
+// merge returns a copy of the setting which is overridden by non-zero fields of other.
+func (ts TimeoutSetting) merge(other *TimeoutSetting) TimeoutSetting {
+	if other == nil {
+		return ts
+	}
+	if other.ConnectTimeout != 0 {
+		ts.ConnectTimeout = other.ConnectTimeout
+	}
+	if other.ResponseHeaderTimeout != 0 {
+		ts.ResponseHeaderTimeout = other.ResponseHeaderTimeout
+	}
+	if other.RequestTimeout != 0 {
+		ts.RequestTimeout = other.RequestTimeout
+	}
+	if other.MaxIdleConnsPerHost > 0 {
+		ts.MaxIdleConnsPerHost = other.MaxIdleConnsPerHost
+	}
+	return ts
+}
+
+// timeoutDuration converts the timeout in milliseconds, zero duration means no timeout for net/http.
+func timeoutDuration(timeout int) time.Duration {
+	if timeout <= 0 {
+		return 0
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// noLimit disables the limit, e.g. the body size limit of config file for the api entry of file uploads.
+const noLimit = -1
+
+// LimitSetting is the size limits of requests.  Zero means the value is inherited from the config file and
+// -1 means no limit, zero of the config file means no limit as well.
+type LimitSetting struct {
+	MaxRequestBodySize int64 `yaml:"max_request_body_size" json:"max_request_body_size" bson:"max_request_body_size"` // bytes
+	MaxHeaderCount     int   `yaml:"max_header_count" json:"max_header_count" bson:"max_header_count"`
+	MaxHeaderSize      int   `yaml:"max_header_size" json:"max_header_size" bson:"max_header_size"` // bytes of all headers
+	MaxURLLength       int   `yaml:"max_url_length" json:"max_url_length" bson:"max_url_length"`
+}
+
+func (ls *LimitSetting) isValid() error {
+	if ls.MaxRequestBodySize < noLimit || ls.MaxHeaderCount < noLimit || ls.MaxHeaderSize < noLimit || ls.MaxURLLength < noLimit {
+		return AppError{ErrorCode: "invalid_input", Message: "limits fields must be -1 or greater"}
+	}
+	return nil
+}
+
+// merge returns a copy of the setting which is overridden by non-zero fields of other.
+func (ls LimitSetting) merge(other *LimitSetting) LimitSetting {
+	if other == nil {
+		return ls
+	}
+	if other.MaxRequestBodySize != 0 {
+		ls.MaxRequestBodySize = other.MaxRequestBodySize
+	}
+	if other.MaxHeaderCount != 0 {
+		ls.MaxHeaderCount = other.MaxHeaderCount
+	}
+	if other.MaxHeaderSize != 0 {
+		ls.MaxHeaderSize = other.MaxHeaderSize
+	}
+	if other.MaxURLLength != 0 {
+		ls.MaxURLLength = other.MaxURLLength
+	}
+	return ls
+}
+
+type RateLimitSetting struct {
+	Store string `yaml:"store"`
+}
+
+// CacheSetting is the store of response cache, redis store uses the address of data setting.
+type CacheSetting struct {
+	Store      string `yaml:"store"`
+	MaxEntries int    `yaml:"max_entries"` // memory store only
+}
+
 type Logs struct {
 	ErrorLog string
 }
@@ -37,11 +192,13 @@ type Configuration struct {
 		AccessLog      bool `yaml:"access_log"`
 		ApplicationLog bool `yaml:"application_log"`
 	}
-	CustomErrors     bool     `yaml:"custom_errors"`
-	Binds            []string `yaml:"binds"`
-	AdminTokens      []string `yaml:"admin_tokens"`
-	ForwardRequestIP bool     `yaml:"forward_request_ip"`
-	ForwardRequestID bool     `yaml:"forward_request_id"`
+	CustomErrors     bool                  `yaml:"custom_errors"`
+	Binds            []string              `yaml:"binds"`
+	AdminTokens      []string              `yaml:"admin_tokens"`
+	ForwardRequestIP bool                  `yaml:"forward_request_ip"`
+	ForwardRequestID bool                  `yaml:"forward_request_id"`
+	TrustedProxies   []string              `yaml:"trusted_proxies"`
+	IPRestriction    *IPRestrictionSetting `yaml:"ip_restriction"`
 	Data             DataSetting
 	Cors             struct {
 		Enable bool `yaml:"enable"`
@@ -49,12 +206,20 @@ type Configuration struct {
 	Gzip struct {
 		Enable bool `yaml:"enable"`
 	}
-	Token TokenSetting
-	TLS   struct {
+	Token     TokenSetting
+	JWT       JWTSetting       `yaml:"jwt"`
+	APIKey    APIKeySetting    `yaml:"api_key"`
+	OAuth     OAuthSetting     `yaml:"oauth"`
+	Timeouts  TimeoutSetting   `yaml:"timeouts"`
+	Limits    LimitSetting     `yaml:"limits"`
+	RateLimit RateLimitSetting `yaml:"rate_limit"`
+	Cache     CacheSetting     `yaml:"cache"`
+	TLS       struct {
 		Enable               bool     `yaml:"enable"`
 		Addr                 string   `yaml:"addr"`
 		ApplyCertDomainNames []string `yaml:"apply_cert_domain_names"`
 	}
+	trustedProxies []*net.IPNet
 }
 
 func newConfiguration() Configuration {
@@ -66,6 +231,39 @@ func newConfiguration() Configuration {
 		Token: TokenSetting{
 			Timeout: 1200, // 20 mins
 		},
+		Limits: LimitSetting{
+			MaxRequestBodySize: 10485760, // 10MB
+			MaxHeaderCount:     100,
+			MaxHeaderSize:      65536, // 64KB
+			MaxURLLength:       8192,
+		},
+		RateLimit: RateLimitSetting{
+			Store: "memory",
+		},
+		Cache: CacheSetting{
+			Store:      "memory",
+			MaxEntries: 10000,
+		},
+		APIKey: APIKeySetting{
+			Header: "X-Api-Key",
+		},
+		OAuth: OAuthSetting{
+			AccessTokenTimeout:  3600,    // 1 hour
+			RefreshTokenTimeout: 2592000, // 30 days
+		},
+		JWT: JWTSetting{
+			Claims: JWTClaimSetting{
+				ConsumerID:   "sub",
+				App:          "app",
+				Roles:        "roles",
+				CustomFields: "custom_fields",
+			},
+		},
+		Timeouts: TimeoutSetting{
+			ConnectTimeout:      10000, // 10 seconds
+			RequestTimeout:      30000, // 30 seconds
+			MaxIdleConnsPerHost: 20,
+		},
 	}
 }
 
@@ -75,5 +273,61 @@ func (c *Configuration) isValid() error {
 			return ErrDataAddr
 		}
 	}
+	switch c.RateLimit.Store {
+	case "memory":
+	case "redis":
+		if len(c.Data.Address) == 0 {
+			return ErrDataAddr
+		}
+	default:
+		return ErrRateLimitStore
+	}
+	switch c.Cache.Store {
+	case "memory":
+	case "redis":
+		if len(c.Data.Address) == 0 {
+			return ErrDataAddr
+		}
+	default:
+		return ErrCacheStore
+	}
+	if err := c.Timeouts.isValid(); err != nil {
+		return err
+	}
+	if err := c.Limits.isValid(); err != nil {
+		return err
+	}
+	trustedProxies, err := parseIPNets(c.TrustedProxies)
+	if err != nil {
+		return ErrTrustedProxies
+	}
+	c.trustedProxies = trustedProxies
+	if c.IPRestriction != nil {
+		if err := c.IPRestriction.isValid(); err != nil {
+			return ErrIPRestriction
+		}
+	}
+	if c.JWT.Enable {
+		if len(c.JWT.Keys) == 0 && len(c.JWT.JWKSFile) == 0 {
+			return ErrJWTKeys
+		}
+		isSigningKeyFound := false
+		for _, key := range c.JWT.Keys {
+			switch key.Algorithm {
+			case jwtHS256, jwtRS256, jwtES256:
+			default:
+				return ErrJWTAlgorithm
+			}
+			if key.Algorithm == jwtHS256 && len(key.Secret) < minJWTSecretLength {
+				return ErrJWTSecret
+			}
+			if len(c.JWT.SigningKey) > 0 && key.ID == c.JWT.SigningKey {
+				isSigningKeyFound = true
+			}
+		}
+		if len(c.JWT.SigningKey) > 0 && !isSigningKeyFound {
+			return ErrJWTSigningKey
+		}
+	}
 	return nil
 }
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestConfigurationJWTSecret(t *testing.T) {
+	tests := []struct {
+		key  JWTKeySetting
+		want error
+	}{
+		{JWTKeySetting{ID: "main", Algorithm: jwtHS256}, ErrJWTSecret},
+		{JWTKeySetting{ID: "main", Algorithm: jwtHS256, Secret: "secret"}, ErrJWTSecret},
+		{JWTKeySetting{ID: "main", Algorithm: jwtHS256, Secret: "0123456789abcdef0123456789abcdef"}, nil},
+		{JWTKeySetting{ID: "main", Algorithm: jwtRS256, PublicKeyFile: "./keys/main.pub"}, nil},
+		{JWTKeySetting{ID: "main", Algorithm: "none"}, ErrJWTAlgorithm},
+	}
+	for _, tt := range tests {
+		config := newConfiguration()
+		config.JWT.Enable = true
+		config.JWT.Keys = []JWTKeySetting{tt.key}
+		if err := config.isValid(); err != tt.want {
+			t.Errorf("%s key with %d bytes secret: err = %v, want %v", tt.key.Algorithm, len(tt.key.Secret), err, tt.want)
+		}
+	}
+}
+
+func TestTimeoutSettingMerge(t *testing.T) {
+	config := TimeoutSetting{ConnectTimeout: 10000, RequestTimeout: 30000}
+	tests := []struct {
+		other *TimeoutSetting
+		want  TimeoutSetting
+	}{
+		{nil, config},
+		{&TimeoutSetting{}, config},
+		{&TimeoutSetting{RequestTimeout: 500}, TimeoutSetting{ConnectTimeout: 10000, RequestTimeout: 500}},
+		{&TimeoutSetting{RequestTimeout: noTimeout, ResponseHeaderTimeout: 200}, TimeoutSetting{ConnectTimeout: 10000, ResponseHeaderTimeout: 200, RequestTimeout: noTimeout}},
+		{&TimeoutSetting{MaxIdleConnsPerHost: 50}, TimeoutSetting{ConnectTimeout: 10000, RequestTimeout: 30000, MaxIdleConnsPerHost: 50}},
+	}
+	for _, tt := range tests {
+		if got := config.merge(tt.other); got != tt.want {
+			t.Errorf("%+v: got %+v, want %+v", tt.other, got, tt.want)
+		}
+	}
+	if err := (&TimeoutSetting{RequestTimeout: -2}).isValid(); err == nil {
+		t.Error("the timeout less than -1 is valid")
+	}
+}
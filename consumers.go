@@ -23,8 +23,27 @@ type Consumer struct {
 	Username     string            `json:"username" bson:"username"`
 	CustomID     string            `json:"custom_id" bson:"custom_id"`
 	CustomFields map[string]string `json:"custom_fields" bson:"custom_fields"`
-	UpdatedAt    time.Time         `json:"updated_at" bson:"updated_at"`
-	CreatedAt    time.Time         `json:"created_at" bson:"created_at"`
+	RateLimits   []*rateLimit      `json:"rate_limits,omitempty" bson:"rate_limits,omitempty"`
+	// PasswordHash and HMACSecret are the credentials of basic and hmac, admin api never shows them.
+	PasswordHash string `json:"-" bson:"password_hash,omitempty"`
+	HMACSecret   string `json:"-" bson:"hmac_secret,omitempty"`
+	// ClientID and ClientSecret are the oauth2 client credentials, only the hash of secret is stored.
+	ClientID         string   `json:"client_id,omitempty" bson:"client_id,omitempty"`
+	ClientSecretHash string   `json:"-" bson:"client_secret_hash,omitempty"`
+	AllowedScopes    []string `json:"allowed_scopes,omitempty" bson:"allowed_scopes,omitempty"`
+	// Scopes are granted by the credential of the request, e.g. api key, they are never stored.
+	Scopes    []string  `json:"-" bson:"-"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// consumerInput is the consumer of admin api, the credentials are accepted but never returned.  The password and
+// the client secret are hashed before the consumer is stored.
+type consumerInput struct {
+	Consumer
+	Password     string `json:"password"`
+	HMACSecret   string `json:"hmac_secret"`
+	ClientSecret string `json:"client_secret"`
 }
 
 func (c *Consumer) isAuthenticated() bool {
@@ -37,6 +56,7 @@ func (c *Consumer) isAuthenticated() bool {
 type ConsumerRepository interface {
 	Get(id string) (*Consumer, error)
 	GetByUsername(app string, username string) (*Consumer, error)
+	GetByClientID(clientID string) (*Consumer, error)
 	Insert(consumer *Consumer) error
 	Update(consumer *Consumer) error
 	Delete(consumer *Consumer) error
@@ -73,6 +93,17 @@ func (cs *ConsumerMemStore) GetByUsername(app string, username string) (*Consume
 	return result, nil
 }
 
+func (cs *ConsumerMemStore) GetByClientID(clientID string) (*Consumer, error) {
+	cs.RLock()
+	defer cs.RUnlock()
+	for _, consumer := range cs.data {
+		if consumer.ClientID == clientID {
+			return consumer, nil
+		}
+	}
+	return nil, nil
+}
+
 func (cs *ConsumerMemStore) Insert(consumer *Consumer) error {
 	if len(consumer.App) == 0 {
 		return AppError{ErrorCode: "invalid_input", Message: "app field was invalid."}
@@ -140,6 +171,17 @@ func newConsumerMongo(connectionString string) (*consumerMongo, error) {
 	if err != nil {
 		return nil, err
 	}
+	clientIdx := mgo.Index{
+		Name:       "consumer_client_idx",
+		Key:        []string{"client_id"},
+		Unique:     true,
+		Background: true,
+		Sparse:     true,
+	}
+	err = c.EnsureIndex(clientIdx)
+	if err != nil {
+		return nil, err
+	}
 
 	return &consumerMongo{
 		connectionString: connectionString,
@@ -188,6 +230,25 @@ func (cm *consumerMongo) GetByUsername(app string, username string) (*Consumer,
 	return &consumer, nil
 }
 
+func (cm *consumerMongo) GetByClientID(clientID string) (*Consumer, error) {
+	session, err := cm.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("consumers")
+	consumer := Consumer{}
+	err = c.Find(bson.M{"client_id": clientID}).One(&consumer)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &consumer, nil
+}
+
 func (cm *consumerMongo) Insert(consumer *Consumer) error {
 	if len(consumer.App) == 0 {
 		return AppError{ErrorCode: "invalid_input", Message: "app field was invalid."}
@@ -275,6 +336,23 @@ type consumerRedis struct {
 	client *redis.Client
 }
 
+// consumerRedisValue keeps the credentials which are hidden from json of Consumer.
+type consumerRedisValue struct {
+	*Consumer
+	PasswordHash     string `json:"password_hash,omitempty"`
+	HMACSecret       string `json:"hmac_secret,omitempty"`
+	ClientSecretHash string `json:"client_secret_hash,omitempty"`
+}
+
+func newConsumerRedisValue(consumer *Consumer) consumerRedisValue {
+	return consumerRedisValue{
+		Consumer:         consumer,
+		PasswordHash:     consumer.PasswordHash,
+		HMACSecret:       consumer.HMACSecret,
+		ClientSecretHash: consumer.ClientSecretHash,
+	}
+}
+
 func newConsumerRedis(addr string, password string, db int) (*consumerRedis, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr:     addr,
@@ -299,11 +377,13 @@ func (source *consumerRedis) Get(id string) (*Consumer, error) {
 		panicIf(err)
 	}
 
-	var consumer Consumer
-	err = json.Unmarshal([]byte(s), &consumer)
+	value := consumerRedisValue{Consumer: &Consumer{}}
+	err = json.Unmarshal([]byte(s), &value)
 	panicIf(err)
-
-	return &consumer, nil
+	value.Consumer.PasswordHash = value.PasswordHash
+	value.Consumer.HMACSecret = value.HMACSecret
+	value.Consumer.ClientSecretHash = value.ClientSecretHash
+	return value.Consumer, nil
 }
 
 func (source *consumerRedis) GetByUsername(app string, username string) (*Consumer, error) {
@@ -323,6 +403,25 @@ func (source *consumerRedis) GetByUsername(app string, username string) (*Consum
 	return consumer, nil
 }
 
+func (source *consumerRedis) GetByClientID(clientID string) (*Consumer, error) {
+	key := "consumer:client_id:" + clientID
+	consumerID, err := source.client.Get(key).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		panicIf(err)
+	}
+
+	consumer, err := source.Get(consumerID)
+	panicIf(err)
+	if consumer == nil || consumer.ClientID != clientID {
+		// the client id was changed
+		return nil, nil
+	}
+	return consumer, nil
+}
+
 func (source *consumerRedis) Insert(consumer *Consumer) error {
 	if len(consumer.App) == 0 {
 		return AppError{ErrorCode: "invalid_input", Message: "app field was invalid."}
@@ -333,7 +432,7 @@ func (source *consumerRedis) Insert(consumer *Consumer) error {
 	consumer.UpdatedAt = now
 
 	// insert to consumer:id
-	val, err := json.Marshal(consumer)
+	val, err := json.Marshal(newConsumerRedisValue(consumer))
 	panicIf(err)
 	key := "consumer:id:" + consumer.ID
 	err = source.client.Set(key, val, 0).Err()
@@ -344,6 +443,13 @@ func (source *consumerRedis) Insert(consumer *Consumer) error {
 	err = source.client.Set(key, consumer.ID, 0).Err()
 	panicIf(err)
 
+	// insert to consumer:client_id
+	if len(consumer.ClientID) > 0 {
+		key = "consumer:client_id:" + consumer.ClientID
+		err = source.client.Set(key, consumer.ID, 0).Err()
+		panicIf(err)
+	}
+
 	return nil
 }
 
@@ -354,12 +460,19 @@ func (source *consumerRedis) Update(consumer *Consumer) error {
 	now := time.Now().UTC()
 	consumer.UpdatedAt = now
 
-	val, err := json.Marshal(consumer)
+	val, err := json.Marshal(newConsumerRedisValue(consumer))
 	panicIf(err)
 
 	key := "consumer:id:" + consumer.ID
 	err = source.client.Set(key, val, 0).Err()
 	panicIf(err)
+
+	// update consumer:client_id
+	if len(consumer.ClientID) > 0 {
+		key = "consumer:client_id:" + consumer.ClientID
+		err = source.client.Set(key, consumer.ID, 0).Err()
+		panicIf(err)
+	}
 	return nil
 }
 
@@ -373,6 +486,13 @@ func (source *consumerRedis) Delete(consumer *Consumer) error {
 	key = "consumer:" + consumer.App + ":username:" + consumer.Username
 	err = source.client.Del(key).Err()
 	panicIf(err)
+
+	// delete consumer:client_id
+	if len(consumer.ClientID) > 0 {
+		key = "consumer:client_id:" + consumer.ClientID
+		err = source.client.Del(key).Err()
+		panicIf(err)
+	}
 	return nil
 }
 
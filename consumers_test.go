@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestConsumerRedisValue(t *testing.T) {
+	consumer := &Consumer{ID: "c1", App: "web", Username: "alice", PasswordHash: "pbkdf2-sha256$1$salt$hash", HMACSecret: "hmac-secret",
+		ClientID: "client", ClientSecretHash: "pbkdf2-sha256$1$salt$client"}
+	data, err := json.Marshal(newConsumerRedisValue(consumer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := consumerRedisValue{Consumer: &Consumer{}}
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatal(err)
+	}
+	if value.Username != "alice" || value.PasswordHash != consumer.PasswordHash || value.HMACSecret != consumer.HMACSecret ||
+		value.ClientSecretHash != consumer.ClientSecretHash {
+		t.Errorf("got %s, want the consumer with its credentials", data)
+	}
+
+	// admin api never shows the credentials
+	data, err = json.Marshal(consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hash") || strings.Contains(string(data), "hmac-secret") {
+		t.Errorf("json of consumer contains the credentials: %s", data)
+	}
+}
+
+func TestConsumerEndpointCredentials(t *testing.T) {
+	_consumerRepo = newConsumerMemStore()
+	router := napnap.NewRouter()
+	router.Put("/v1/consumers", createOrupateConsumerEndpoint)
+	admin := newTestAdmin(t, router)
+
+	tests := []struct {
+		name         string
+		body         string
+		wantStatus   int
+		wantPassword string
+		wantSecret   string
+		wantClient   string
+	}{
+		{"create", `{"app": "web", "username": "alice", "password": "secret", "hmac_secret": "hmac-secret", "client_id": "c1", "client_secret": "client-secret"}`,
+			201, "secret", "hmac-secret", "client-secret"},
+		{"credentials are kept", `{"app": "web", "username": "alice", "roles": ["member"]}`, 200, "secret", "hmac-secret", "client-secret"},
+		{"hashes aren't accepted", `{"app": "web", "username": "alice", "password_hash": "pbkdf2-sha256$1$c2FsdA$aGFzaA", "client_secret_hash": "pbkdf2-sha256$1$c2FsdA$aGFzaA"}`,
+			200, "secret", "hmac-secret", "client-secret"},
+		{"credentials are replaced", `{"app": "web", "username": "alice", "password": "other", "hmac_secret": "other-secret", "client_id": "c1", "client_secret": "other-client"}`,
+			200, "other", "other-secret", "other-client"},
+		{"new client id", `{"app": "web", "username": "alice", "client_id": "c2"}`, 200, "other", "other-secret", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("PUT", admin.URL+"/v1/consumers", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Fatalf("%s: got %d %s, want %d", tt.name, resp.StatusCode, body, tt.wantStatus)
+		}
+		for _, secret := range []string{"password", "hmac_secret", "client_secret", "secret\""} {
+			if strings.Contains(string(body), secret) {
+				t.Errorf("%s: response contains %s: %s", tt.name, secret, body)
+			}
+		}
+
+		consumer, err := _consumerRepo.GetByUsername("web", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verifyPassword(consumer.PasswordHash, tt.wantPassword) || consumer.HMACSecret != tt.wantSecret {
+			t.Errorf("%s: the stored credentials don't match %q and %q", tt.name, tt.wantPassword, tt.wantSecret)
+		}
+		if (len(tt.wantClient) > 0) != verifyPassword(consumer.ClientSecretHash, tt.wantClient) {
+			t.Errorf("%s: the stored client secret doesn't match %q", tt.name, tt.wantClient)
+		}
+	}
+}
@@ -10,11 +10,12 @@ import (
 )
 
 func createOrupateConsumerEndpoint(c *napnap.Context) {
-	var target Consumer
-	err := c.BindJSON(&target)
+	var input consumerInput
+	err := c.BindJSON(&input)
 	if err != nil {
 		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
 	}
+	target := input.Consumer
 
 	if len(target.Username) == 0 {
 		panic(AppError{ErrorCode: "invalid_input", Message: "username field is invalid."})
@@ -24,9 +25,33 @@ func createOrupateConsumerEndpoint(c *napnap.Context) {
 		panic(AppError{ErrorCode: "invalid_input", Message: "app field is invalid."})
 	}
 
+	for _, rl := range target.RateLimits {
+		err = rl.isValid()
+		panicIf(err)
+	}
+
+	if len(input.Password) > 0 {
+		target.PasswordHash = hashPassword(input.Password)
+	}
+	target.HMACSecret = input.HMACSecret
+	if len(input.ClientSecret) > 0 {
+		if len(target.ClientID) == 0 {
+			panic(AppError{ErrorCode: "invalid_input", Message: "client_id field is required by client_secret."})
+		}
+		target.ClientSecretHash = hashPassword(input.ClientSecret)
+	}
+
 	consumer, err := _consumerRepo.GetByUsername(target.App, target.Username)
 	panicIf(err)
 
+	if len(target.ClientID) > 0 {
+		owner, err := _consumerRepo.GetByClientID(target.ClientID)
+		panicIf(err)
+		if owner != nil && (consumer == nil || owner.ID != consumer.ID) {
+			panic(AppError{ErrorCode: "invalid_input", Message: "client_id field was used by another consumer."})
+		}
+	}
+
 	if consumer == nil {
 		// create consumer
 		target.ID = uuid.NewV4().String()
@@ -36,9 +61,22 @@ func createOrupateConsumerEndpoint(c *napnap.Context) {
 		return
 	}
 
-	// update consumer
+	// update consumer, the credentials which are omitted are kept
 	target.ID = consumer.ID
 	target.CreatedAt = consumer.CreatedAt
+	if len(target.PasswordHash) == 0 {
+		target.PasswordHash = consumer.PasswordHash
+	}
+	if len(target.HMACSecret) == 0 {
+		target.HMACSecret = consumer.HMACSecret
+	}
+	if len(target.ClientID) == 0 {
+		target.ClientID = consumer.ClientID
+	}
+	// the secret of the old client id isn't moved to a new one
+	if len(target.ClientSecretHash) == 0 && target.ClientID == consumer.ClientID {
+		target.ClientSecretHash = consumer.ClientSecretHash
+	}
 	err = _consumerRepo.Update(&target)
 	panicIf(err)
 	c.JSON(200, target)
@@ -101,9 +139,69 @@ func deletedConsumerEndpoint(c *napnap.Context) {
 
 	err = _consumerRepo.Delete(consumer)
 	panicIf(err)
+	err = _apiKeyRepo.DeleteByConsumerID(consumer.ID)
+	panicIf(err)
 	c.JSON(204, nil)
 }
 
+func listAPIKeysEndpoint(c *napnap.Context) {
+	consumerID := c.Param("consumer_id")
+	keys, err := _apiKeyRepo.GetByConsumerID(consumerID)
+	panicIf(err)
+	if keys == nil {
+		keys = []*APIKey{}
+	}
+	result := apiKeyCollection{
+		Count:   len(keys),
+		APIKeys: keys,
+	}
+	c.JSON(200, result)
+}
+
+func createAPIKeyEndpoint(c *napnap.Context) {
+	var target APIKey
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+
+	if len(target.Name) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "name field is invalid."})
+	}
+
+	consumerID := c.Param("consumer_id")
+	consumer, err := _consumerRepo.Get(consumerID)
+	panicIf(err)
+	if consumer == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "consumer was not found."})
+	}
+
+	apiKey := newAPIKey(consumer.ID)
+	apiKey.Name = target.Name
+	apiKey.Scopes = target.Scopes
+	if apiKey.Scopes == nil {
+		apiKey.Scopes = []string{}
+	}
+	err = _apiKeyRepo.Insert(apiKey)
+	panicIf(err)
+	c.JSON(201, apiKey)
+}
+
+func deleteAPIKeyEndpoint(c *napnap.Context) {
+	consumerID := c.Param("consumer_id")
+	keyID := c.Param("key_id")
+
+	apiKey, err := _apiKeyRepo.Get(keyID)
+	panicIf(err)
+	if apiKey == nil || apiKey.ConsumerID != consumerID {
+		panic(AppError{ErrorCode: "not_found", Message: "api key was not found"})
+	}
+
+	err = _apiKeyRepo.Delete(apiKey.ID)
+	panicIf(err)
+	c.SetStatus(204)
+}
+
 func getTokenEndpoint(c *napnap.Context) {
 	id := c.Param("id")
 
@@ -171,8 +269,31 @@ func createTokenEndpoint(c *napnap.Context) {
 	}
 	target.ExpiresIn = int64(target.Expiration.Sub(now).Seconds())
 
-	err = _tokenRepo.Insert(&target)
-	panicIf(err)
+	format := target.Format
+	if len(format) == 0 {
+		format = tokenFormatOpaque
+	}
+	target.Format = ""
+	if format != tokenFormatOpaque && format != tokenFormatJWT && format != tokenFormatBoth {
+		panic(AppError{ErrorCode: "invalid_input", Message: "format field must be opaque, jwt or both."})
+	}
+
+	var accessToken string
+	if format == tokenFormatJWT || format == tokenFormatBoth {
+		accessToken, err = _jwtKeys.newJWT(consumer, target.Expiration, _config.JWT)
+		if err == ErrJWTSigning {
+			panic(AppError{ErrorCode: "invalid_input", Message: "jwt signing key is not configured."})
+		}
+		panicIf(err)
+	}
+
+	// the jwt is self-contained, only opaque token needs to be stored.
+	if format != tokenFormatJWT {
+		err = _tokenRepo.Insert(&target)
+		panicIf(err)
+	}
+	target.Format = format
+	target.AccessToken = accessToken
 	c.JSON(201, target)
 }
 
@@ -257,9 +378,10 @@ func createAPIEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
 	}
-	if len(target.Name) == 0 {
-		panic(AppError{ErrorCode: "invalid_input", Message: "name field can't be empty or null"})
-	}
+	err = target.isValid()
+	panicIf(err)
+	err = target.checkServices()
+	panicIf(err)
 	/*
 		api, err := _apiRepo.GetByName(target.Name)
 		panicIf(err)
@@ -279,7 +401,7 @@ func getAPIEndpoint(c *napnap.Context) {
 	apiID := c.Param("api_id")
 
 	var result *api
-	for _, api := range _apis {
+	for _, api := range currentRoutes().apis {
 		if api.ID == apiID {
 			result = api
 			break
@@ -313,10 +435,10 @@ func listAPIEndpoint(c *napnap.Context) {
 		}
 	}
 
-	if len(_apis) > 0 {
+	if apis := currentRoutes().apis; len(apis) > 0 {
 		result = &apiCollection{
-			Count: len(_apis),
-			APIs:  _apis,
+			Count: len(apis),
+			APIs:  apis,
 		}
 	}
 	c.JSON(200, result)
@@ -329,9 +451,10 @@ func updateAPIEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
 	}
-	if len(target.Name) == 0 {
-		panic(AppError{ErrorCode: "invalid_input", Message: "name field can't be empty"})
-	}
+	err = target.isValid()
+	panicIf(err)
+	err = target.checkServices()
+	panicIf(err)
 
 	api, err := _apiRepo.Get(apiID)
 	panicIf(err)
@@ -394,15 +517,63 @@ func switchAPISource(c *napnap.Context) {
 	panicIf(err)
 
 	// reload api
-	_apis, err = _apiRepo.GetAll()
+	apis, err := _apiRepo.GetAll()
 	panicIf(err)
+	setAPIs(apis)
 	c.SetStatus(200)
 }
 
 func reloadAPIEndpoint(c *napnap.Context) {
-	var err error
-	_apis, err = _apiRepo.GetAll()
+	apis, err := _apiRepo.GetAll()
 	panicIf(err)
+	setAPIs(apis)
+	c.SetStatus(204)
+}
+
+func updateTrafficSplitEndpoint(c *napnap.Context) {
+	apiID := c.Param("api_id")
+	var target trafficSplit
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	err = target.isValid()
+	panicIf(err)
+	err = target.checkServices(currentRoutes())
+	panicIf(err)
+
+	api, err := _apiRepo.Get(apiID)
+	panicIf(err)
+	if api == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "api was not found"})
+	}
+	api.TrafficSplit = &target
+	err = _apiRepo.Update(api)
+	panicIf(err)
+
+	// reload api
+	apis, err := _apiRepo.GetAll()
+	panicIf(err)
+	setAPIs(apis)
+	c.JSON(200, api)
+}
+
+// deleteTrafficSplitEndpoint rolls back all traffic to the service field of api entry.
+func deleteTrafficSplitEndpoint(c *napnap.Context) {
+	apiID := c.Param("api_id")
+	api, err := _apiRepo.Get(apiID)
+	panicIf(err)
+	if api == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "api was not found"})
+	}
+	api.TrafficSplit = nil
+	err = _apiRepo.Update(api)
+	panicIf(err)
+
+	// reload api
+	apis, err := _apiRepo.GetAll()
+	panicIf(err)
+	setAPIs(apis)
 	c.SetStatus(204)
 }
 
@@ -464,9 +635,8 @@ func createServicesEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
 	}
-	if len(target.Name) == 0 {
-		panic(AppError{ErrorCode: "invalid_input", Message: "name field can't be empty or null"})
-	}
+	err = target.isValid()
+	panicIf(err)
 	service, err := _serviceRepo.GetByName(target.Name)
 	panicIf(err)
 	if service != nil {
@@ -485,7 +655,7 @@ func getServicesEndpoint(c *napnap.Context) {
 	serviceID := c.Param("service_id")
 
 	var result *service
-	for _, svc := range _services {
+	for _, svc := range currentRoutes().serviceList {
 		if svc.ID == serviceID {
 			result = svc
 			break
@@ -500,7 +670,7 @@ func getServicesEndpoint(c *napnap.Context) {
 		panic(AppError{ErrorCode: "not_found", Message: "service was not found"})
 	}
 
-	c.JSON(200, result)
+	c.JSON(200, result.snapshot())
 }
 
 func listServicesEndpoint(c *napnap.Context) {
@@ -518,10 +688,14 @@ func listServicesEndpoint(c *napnap.Context) {
 			return
 		}
 	}
-	if len(_services) > 0 {
+	if serviceList := currentRoutes().serviceList; len(serviceList) > 0 {
+		services := make([]*service, 0, len(serviceList))
+		for _, svc := range serviceList {
+			services = append(services, svc.snapshot())
+		}
 		result = &serviceCollection{
-			Count:    len(_services),
-			Services: _services,
+			Count:    len(services),
+			Services: services,
 		}
 	}
 	c.JSON(200, result)
@@ -534,9 +708,8 @@ func updateServicesEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
 	}
-	if len(target.Name) == 0 {
-		panic(AppError{ErrorCode: "invalid_input", Message: "name field can't be empty"})
-	}
+	err = target.isValid()
+	panicIf(err)
 
 	service, err := _serviceRepo.Get(serviceID)
 	panicIf(err)
@@ -584,7 +757,7 @@ func registerServiceUpstreamEndpoint(c *napnap.Context) {
 
 	serviceID := c.Param("service_id")
 	var service *service
-	for _, svc := range _services {
+	for _, svc := range currentRoutes().serviceList {
 		if svc.ID == serviceID || svc.Name == serviceID {
 			service = svc
 		}
@@ -600,7 +773,7 @@ func registerServiceUpstreamEndpoint(c *napnap.Context) {
 func unregisterServiceUpstreamEndpoint(c *napnap.Context) {
 	serviceID := c.Param("service_id")
 	var service *service
-	for _, svc := range _services {
+	for _, svc := range currentRoutes().serviceList {
 		if svc.ID == serviceID {
 			service = svc
 		} else if svc.Name == serviceID {
@@ -626,14 +799,7 @@ func unregisterServiceUpstreamEndpoint(c *napnap.Context) {
 func reloadServiceEndpoint(c *napnap.Context) {
 	services, err := _serviceRepo.GetAll()
 	panicIf(err)
-	for _, newSvc := range services {
-		for _, oldSvc := range _services {
-			if newSvc.ID == oldSvc.ID {
-				newSvc.Upstreams = oldSvc.Upstreams
-			}
-		}
-	}
-	_services = services
+	setServices(services)
 	c.SetStatus(204)
 }
 
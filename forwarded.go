@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// isTrustedProxy reports whether the forwarding headers which are sent by ip can be trusted.
+// All peers are trusted when trusted_proxies is empty which is the original behaviour.
+func isTrustedProxy(ip string) bool {
+	if len(_config.trustedProxies) == 0 {
+		return true
+	}
+	return containsIP(_config.trustedProxies, ip)
+}
+
+// getClientIP returns the ip address of the client.  The forwarding chain is walked from the nearest proxy
+// and the first address which is not a trusted proxy is the client.
+func getClientIP(req *http.Request) string {
+	peer := remoteIP(req)
+	if !isTrustedProxy(peer) {
+		return normalizeIP(peer)
+	}
+
+	realIP := strings.TrimSpace(req.Header.Get("X-Real-Ip"))
+	chain := forwardedChain(req.Header)
+	if len(_config.trustedProxies) == 0 {
+		// the original behaviour, X-Real-Ip or the first address of X-Forwarded-For
+		if len(realIP) > 0 {
+			return normalizeIP(realIP)
+		}
+		if len(chain) > 0 {
+			return normalizeIP(chain[0])
+		}
+		return normalizeIP(peer)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !isTrustedProxy(chain[i]) {
+			return normalizeIP(chain[i])
+		}
+	}
+	if len(chain) > 0 {
+		// every node is trusted, the first one is the client
+		return normalizeIP(chain[0])
+	}
+	if len(realIP) > 0 {
+		return normalizeIP(realIP)
+	}
+	return normalizeIP(peer)
+}
+
+// getAccessControlIP returns the client ip which is checked by access control, e.g. ip restriction.  Anyone can
+// send the forwarding headers, so they are only believed when trusted_proxies is set, otherwise the address of
+// the peer is used.
+func getAccessControlIP(req *http.Request) string {
+	if len(_config.trustedProxies) == 0 {
+		return normalizeIP(remoteIP(req))
+	}
+	return getClientIP(req)
+}
+
+func normalizeIP(ip string) string {
+	if len(ip) > 0 && ip == "::1" {
+		return "127.0.0.1"
+	}
+	return ip
+}
+
+// remoteIP returns the ip address of the peer which connects to bifrost.
+func remoteIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(req.RemoteAddr))
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+// forwardedChain returns the client addresses of the forwarding headers, the first one is the original client.
+// X-Forwarded-For is preferred, Forwarded (RFC 7239) is used when it is missing.
+func forwardedChain(header http.Header) []string {
+	chain := []string{}
+	if values := header["X-Forwarded-For"]; len(values) > 0 {
+		for _, value := range values {
+			for _, ip := range strings.Split(value, ",") {
+				ip = strings.TrimSpace(ip)
+				if len(ip) > 0 {
+					chain = append(chain, ip)
+				}
+			}
+		}
+		return chain
+	}
+
+	for _, value := range header["Forwarded"] {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+					continue
+				}
+				chain = append(chain, parseForwardedNode(pair[4:]))
+			}
+		}
+	}
+	return chain
+}
+
+// parseForwardedNode returns the ip address of the node of Forwarded header, e.g. "[2001:db8::1]:4711".
+func parseForwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// formatForwardedNode quotes the ipv6 address for Forwarded header.
+func formatForwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// setForwardedHeaders appends the peer to the forwarding chain and sets the standard forwarding headers.
+// The headers which are sent by untrusted peers are discarded.
+func setForwardedHeaders(c *napnap.Context, outReq *http.Request) {
+	req := c.Request
+	peer := remoteIP(req)
+	trusted := isTrustedProxy(peer)
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	host := req.Host
+	port := ""
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		_, port, _ = net.SplitHostPort(addr.String())
+	}
+	if trusted {
+		if val := req.Header.Get("X-Forwarded-Proto"); len(val) > 0 {
+			proto = val
+		}
+		if val := req.Header.Get("X-Forwarded-Host"); len(val) > 0 {
+			host = val
+		}
+		if val := req.Header.Get("X-Forwarded-Port"); len(val) > 0 {
+			port = val
+		}
+	}
+
+	// X-Forwarded-For
+	xff := normalizeIP(peer)
+	if trusted {
+		if prior := req.Header["X-Forwarded-For"]; len(prior) > 0 {
+			xff = strings.Join(prior, ", ") + ", " + xff
+		}
+	}
+	outReq.Header.Set("X-Forwarded-For", xff)
+	outReq.Header.Set("X-Forwarded-Proto", proto)
+	outReq.Header.Set("X-Forwarded-Host", host)
+	if len(port) > 0 {
+		outReq.Header.Set("X-Forwarded-Port", port)
+	} else {
+		outReq.Header.Del("X-Forwarded-Port")
+	}
+
+	// Forwarded, RFC 7239
+	forwarded := "for=" + formatForwardedNode(normalizeIP(peer)) + ";host=" + `"` + req.Host + `"` + ";proto=" + proto
+	if trusted {
+		if prior := req.Header["Forwarded"]; len(prior) > 0 {
+			forwarded = strings.Join(prior, ", ") + ", " + forwarded
+		}
+	}
+	outReq.Header.Set("Forwarded", forwarded)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestForwardedChain(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   []string
+	}{
+		{http.Header{}, []string{}},
+		{http.Header{"X-Forwarded-For": {"1.1.1.1, 2.2.2.2", "3.3.3.3"}}, []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}},
+		{http.Header{"X-Forwarded-For": {" 1.1.1.1 ,, "}}, []string{"1.1.1.1"}},
+		{http.Header{"Forwarded": {"for=1.1.1.1"}}, []string{"1.1.1.1"}},
+		{http.Header{"Forwarded": {`For="[2001:db8::1]:4711";proto=https, for=2.2.2.2:80`}}, []string{"2001:db8::1", "2.2.2.2"}},
+		{http.Header{"Forwarded": {"proto=https;for=1.1.1.1;by=3.3.3.3", "for=2.2.2.2"}}, []string{"1.1.1.1", "2.2.2.2"}},
+		{http.Header{"Forwarded": {"by=3.3.3.3"}}, []string{}},
+		// X-Forwarded-For wins over Forwarded
+		{http.Header{"X-Forwarded-For": {"1.1.1.1"}, "Forwarded": {"for=2.2.2.2"}}, []string{"1.1.1.1"}},
+	}
+	for _, tt := range tests {
+		if got := forwardedChain(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("forwardedChain(%v) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestParseForwardedNode(t *testing.T) {
+	tests := []struct {
+		node string
+		want string
+	}{
+		{"1.1.1.1", "1.1.1.1"},
+		{"1.1.1.1:80", "1.1.1.1"},
+		{`"[2001:db8::1]"`, "2001:db8::1"},
+		{`"[2001:db8::1]:4711"`, "2001:db8::1"},
+		{`"[2001:db8::1`, "[2001:db8::1"},
+		{"unknown", "unknown"},
+		{"_hidden", "_hidden"},
+	}
+	for _, tt := range tests {
+		if got := parseForwardedNode(tt.node); got != tt.want {
+			t.Errorf("parseForwardedNode(%s) = %s, want %s", tt.node, got, tt.want)
+		}
+	}
+}
+
+func TestFormatForwardedNode(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.1.1.1", "1.1.1.1"},
+		{"2001:db8::1", `"[2001:db8::1]"`},
+	}
+	for _, tt := range tests {
+		if got := formatForwardedNode(tt.ip); got != tt.want {
+			t.Errorf("formatForwardedNode(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	tests := []struct {
+		trustedProxies []string
+		remoteAddr     string
+		header         http.Header
+		want           string
+		wantAccess     string
+	}{
+		// without trusted proxies the headers are believed, but not by access control
+		{nil, "10.0.0.1:1234", http.Header{}, "10.0.0.1", "10.0.0.1"},
+		{nil, "[::1]:1234", http.Header{}, "127.0.0.1", "127.0.0.1"},
+		{nil, "10.0.0.1:1234", http.Header{"X-Real-Ip": {"1.1.1.1"}, "X-Forwarded-For": {"2.2.2.2"}}, "1.1.1.1", "10.0.0.1"},
+		{nil, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"2.2.2.2, 3.3.3.3"}}, "2.2.2.2", "10.0.0.1"},
+		{nil, "10.0.0.1:1234", http.Header{"Forwarded": {"for=2.2.2.2"}}, "2.2.2.2", "10.0.0.1"},
+		// the headers of untrusted peers are ignored
+		{[]string{"10.0.0.0/8"}, "4.4.4.4:1234", http.Header{"X-Forwarded-For": {"2.2.2.2"}}, "4.4.4.4", "4.4.4.4"},
+		// the chain is walked from the nearest proxy
+		{[]string{"10.0.0.0/8"}, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"2.2.2.2, 3.3.3.3, 10.0.0.2"}}, "3.3.3.3", "3.3.3.3"},
+		{[]string{"10.0.0.0/8"}, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3", "10.0.0.3"},
+		{[]string{"10.0.0.0/8"}, "10.0.0.1:1234", http.Header{"X-Real-Ip": {"1.1.1.1"}}, "1.1.1.1", "1.1.1.1"},
+		{[]string{"10.0.0.0/8"}, "10.0.0.1:1234", http.Header{}, "10.0.0.1", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		_config = newConfiguration()
+		trustedProxies, err := parseIPNets(tt.trustedProxies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_config.trustedProxies = trustedProxies
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header = tt.header
+		if got := getClientIP(req); got != tt.want {
+			t.Errorf("trusted %v, peer %s, header %v: getClientIP = %s, want %s", tt.trustedProxies, tt.remoteAddr, tt.header, got, tt.want)
+		}
+		if got := getAccessControlIP(req); got != tt.wantAccess {
+			t.Errorf("trusted %v, peer %s, header %v: getAccessControlIP = %s, want %s", tt.trustedProxies, tt.remoteAddr, tt.header, got, tt.wantAccess)
+		}
+	}
+	_config = newConfiguration()
+}
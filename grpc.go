@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+const (
+	protocolHTTP1 = "http1"
+	protocolHTTP2 = "h2"  // HTTP/2 over TLS, HTTP/1.1 is used when upstream doesn't support it
+	protocolH2C   = "h2c" // HTTP/2 only, cleartext for http:// and TLS for https://
+)
+
+func isValidProtocol(protocol string) bool {
+	switch protocol {
+	case "", protocolHTTP1, protocolHTTP2, protocolH2C:
+		return true
+	}
+	return false
+}
+
+func isGRPCRequest(req *http.Request) bool {
+	return req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// upstreamProtocol returns the protocol which is used to send the request.  Protocol of api entry overrides
+// protocol of service, gRPC requests use HTTP/2 when neither of them is set.
+func upstreamProtocol(apiEntry *api, svcEntry *service, req *http.Request) string {
+	if len(apiEntry.Protocol) > 0 {
+		return apiEntry.Protocol
+	}
+	if svcEntry != nil && len(svcEntry.Protocol) > 0 {
+		return svcEntry.Protocol
+	}
+	if isGRPCRequest(req) {
+		return protocolH2C
+	}
+	return protocolHTTP1
+}
+
+// newTransportProtocols returns the protocols of upstream transport, nil means the default HTTP/1.1.
+func newTransportProtocols(protocol string) *http.Protocols {
+	protocols := new(http.Protocols)
+	switch protocol {
+	case protocolHTTP2:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case protocolH2C:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil
+	}
+	return protocols
+}
+
+// recordGRPCStatus keeps grpc-status of the response for access log.  gRPC errors are sent with http status 200,
+// so the error is mapped to http status, otherwise they look like successful requests in the access log.
+func recordGRPCStatus(c *napnap.Context, resp *http.Response) {
+	value := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if len(value) == 0 {
+		// trailers-only response
+		value = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if len(value) == 0 {
+		return
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	c.Set("grpc_status", code)
+	if code == 0 {
+		return
+	}
+	if decoded, err := url.PathUnescape(message); err == nil {
+		message = decoded
+	}
+	c.Set("status_code", grpcHTTPStatus(code))
+	c.Set("error", "grpc-status: "+value+", grpc-message: "+message)
+}
+
+// grpcHTTPStatus maps gRPC status code to http status code.
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+func grpcHTTPStatus(code int) int {
+	switch code {
+	case 0: // OK
+		return 200
+	case 1: // CANCELLED
+		return 499
+	case 3, 9, 11: // INVALID_ARGUMENT, FAILED_PRECONDITION, OUT_OF_RANGE
+		return 400
+	case 4: // DEADLINE_EXCEEDED
+		return 504
+	case 5: // NOT_FOUND
+		return 404
+	case 6, 10: // ALREADY_EXISTS, ABORTED
+		return 409
+	case 7: // PERMISSION_DENIED
+		return 403
+	case 8: // RESOURCE_EXHAUSTED
+		return 429
+	case 12: // UNIMPLEMENTED
+		return 501
+	case 14: // UNAVAILABLE
+		return 503
+	case 16: // UNAUTHENTICATED
+		return 401
+	default: // UNKNOWN, INTERNAL, DATA_LOSS
+		return 500
+	}
+}
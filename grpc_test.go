@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestGRPCHTTPStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		want int
+	}{
+		{0, 200},  // OK
+		{1, 499},  // CANCELLED
+		{2, 500},  // UNKNOWN
+		{3, 400},  // INVALID_ARGUMENT
+		{4, 504},  // DEADLINE_EXCEEDED
+		{5, 404},  // NOT_FOUND
+		{6, 409},  // ALREADY_EXISTS
+		{7, 403},  // PERMISSION_DENIED
+		{8, 429},  // RESOURCE_EXHAUSTED
+		{9, 400},  // FAILED_PRECONDITION
+		{10, 409}, // ABORTED
+		{11, 400}, // OUT_OF_RANGE
+		{12, 501}, // UNIMPLEMENTED
+		{13, 500}, // INTERNAL
+		{14, 503}, // UNAVAILABLE
+		{15, 500}, // DATA_LOSS
+		{16, 401}, // UNAUTHENTICATED
+		{17, 500}, // unknown code
+	}
+	for _, tt := range tests {
+		if got := grpcHTTPStatus(tt.code); got != tt.want {
+			t.Errorf("grpcHTTPStatus(%d) = %d, want %d", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestRecordGRPCStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		trailer    http.Header
+		wantGRPC   interface{}
+		wantStatus interface{}
+		wantError  interface{}
+	}{
+		{"no status", http.Header{}, http.Header{}, nil, nil, nil},
+		{"ok", http.Header{}, http.Header{"Grpc-Status": {"0"}}, 0, nil, nil},
+		{"error in trailer", http.Header{}, http.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"user%20not%20found"}}, 5, 404, "grpc-status: 5, grpc-message: user not found"},
+		{"trailers-only", http.Header{"Grpc-Status": {"16"}, "Grpc-Message": {"denied"}}, http.Header{}, 16, 401, "grpc-status: 16, grpc-message: denied"},
+		{"invalid status", http.Header{}, http.Header{"Grpc-Status": {"x"}}, nil, nil, nil},
+	}
+	for _, tt := range tests {
+		c := napnap.NewContext(napnap.New(), httptest.NewRequest("POST", "http://example.com/", nil), nil)
+		recordGRPCStatus(c, &http.Response{Header: tt.header, Trailer: tt.trailer})
+		for key, want := range map[string]interface{}{"grpc_status": tt.wantGRPC, "status_code": tt.wantStatus, "error": tt.wantError} {
+			got, _ := c.Get(key)
+			if got != want {
+				t.Errorf("%s: %s = %v, want %v", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+	grpcReq := httptest.NewRequest("POST", "http://example.com/", nil)
+	grpcReq.ProtoMajor = 2
+	grpcReq.Header.Set("Content-Type", "application/grpc+proto")
+	httpReq := httptest.NewRequest("GET", "http://example.com/", nil)
+
+	tests := []struct {
+		api     *api
+		service *service
+		req     *http.Request
+		want    string
+	}{
+		{&api{}, nil, httpReq, protocolHTTP1},
+		{&api{}, nil, grpcReq, protocolH2C},
+		{&api{}, &service{Protocol: protocolHTTP2}, grpcReq, protocolHTTP2},
+		{&api{Protocol: protocolHTTP1}, &service{Protocol: protocolHTTP2}, httpReq, protocolHTTP1},
+	}
+	for _, tt := range tests {
+		if got := upstreamProtocol(tt.api, tt.service, tt.req); got != tt.want {
+			t.Errorf("api %q, service %+v: got %s, want %s", tt.api.Protocol, tt.service, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// headerRules are applied in the order remove, rename, set and add, the rules of rename, set and add are
+// applied in the order of header names.
+// Values of set and add are templates, the supported variables are:
+//
+//	{request_id}, {client_ip}, {host}, {method}, {path}
+//	{consumer.id}, {consumer.app}, {consumer.username}, {consumer.custom_id}, {consumer.roles}
+//	{consumer.<custom field>}, {param.<path parameter>}, {header.<request header>}
+//
+// Unknown variables are replaced with empty string.
+type headerRules struct {
+	Add    map[string]string `json:"add,omitempty" bson:"add,omitempty"`
+	Set    map[string]string `json:"set,omitempty" bson:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty" bson:"remove,omitempty"`
+	Rename map[string]string `json:"rename,omitempty" bson:"rename,omitempty"`
+}
+
+type headerTransform struct {
+	Request  *headerRules `json:"request,omitempty" bson:"request,omitempty"`
+	Response *headerRules `json:"response,omitempty" bson:"response,omitempty"`
+}
+
+func (t *headerTransform) isValid() error {
+	if t.Request != nil {
+		err := t.Request.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if t.Response != nil {
+		err := t.Response.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *headerRules) isValid() error {
+	for _, name := range r.Remove {
+		if len(name) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "header name of remove rule can't be empty"}
+		}
+	}
+	for from, to := range r.Rename {
+		if len(from) == 0 || len(to) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "header name of rename rule can't be empty"}
+		}
+	}
+	for _, values := range []map[string]string{r.Set, r.Add} {
+		for name, value := range values {
+			if len(name) == 0 {
+				return AppError{ErrorCode: "invalid_input", Message: "header name of set or add rule can't be empty"}
+			}
+			if !isValidTemplate(value) {
+				return AppError{ErrorCode: "invalid_input", Message: "header value is an invalid template: " + value}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *headerRules) apply(header http.Header, vars *templateVars) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.Remove {
+		header.Del(name)
+	}
+	for _, from := range sortedKeys(r.Rename) {
+		to := r.Rename[from]
+		values, ok := header[http.CanonicalHeaderKey(from)]
+		if !ok {
+			continue
+		}
+		header.Del(from)
+		header.Del(to)
+		for _, value := range values {
+			header.Add(to, value)
+		}
+	}
+	for _, name := range sortedKeys(r.Set) {
+		header.Set(name, vars.expand(r.Set[name]))
+	}
+	for _, name := range sortedKeys(r.Add) {
+		header.Add(name, vars.expand(r.Add[name]))
+	}
+}
+
+// sortedKeys returns the header names of rules in order, so the rules which touch the same header, e.g. two
+// renames to one name, always give the same result.
+func sortedKeys(rules map[string]string) []string {
+	keys := make([]string, 0, len(rules))
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// templateVars resolves the variables of header templates for a request.
+type templateVars struct {
+	c        *napnap.Context
+	consumer Consumer
+	params   map[string]string
+}
+
+func newTemplateVars(c *napnap.Context, consumer Consumer, route *routeMatch) *templateVars {
+	vars := &templateVars{
+		c:        c,
+		consumer: consumer,
+	}
+	if route != nil {
+		vars.params = route.params
+	}
+	return vars
+}
+
+func (v *templateVars) lookup(name string) string {
+	switch name {
+	case "request_id":
+		requestID, _ := v.c.Get("request-id")
+		s, _ := requestID.(string)
+		return s
+	case "client_ip":
+		return getClientIP(v.c.Request)
+	case "host":
+		return v.c.Request.Host
+	case "method":
+		return v.c.Request.Method
+	case "path":
+		return v.c.Request.URL.Path
+	case "consumer.id":
+		return v.consumer.ID
+	case "consumer.app":
+		return v.consumer.App
+	case "consumer.username":
+		return v.consumer.Username
+	case "consumer.custom_id":
+		return v.consumer.CustomID
+	case "consumer.roles":
+		return strings.Join(v.consumer.Roles, ",")
+	}
+
+	switch {
+	case strings.HasPrefix(name, "consumer."):
+		return v.consumer.CustomFields[name[len("consumer."):]]
+	case strings.HasPrefix(name, "param."):
+		return v.params[name[len("param."):]]
+	case strings.HasPrefix(name, "header."):
+		return v.c.Request.Header.Get(name[len("header."):])
+	}
+	return ""
+}
+
+// expand replaces every {name} of the template with its value.
+func (v *templateVars) expand(template string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	var result []byte
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			break
+		}
+		result = append(result, template[:start]...)
+		result = append(result, v.lookup(template[start+1:start+end])...)
+		template = template[start+end+1:]
+	}
+	result = append(result, template...)
+	return string(result)
+}
+
+func isValidTemplate(template string) bool {
+	depth := 0
+	for _, r := range template {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+		if depth < 0 || depth > 1 {
+			return false
+		}
+	}
+	return depth == 0
+}
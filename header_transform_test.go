@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRulesIsValid(t *testing.T) {
+	tests := []struct {
+		rules   headerRules
+		wantErr bool
+	}{
+		{headerRules{Set: map[string]string{"X-User": "{consumer.username}"}}, false},
+		{headerRules{Add: map[string]string{"X-Path": "{path}-{param.id}"}}, false},
+		{headerRules{Set: map[string]string{"X-User": "{consumer.{username}}"}}, true},
+		{headerRules{Set: map[string]string{"X-User": "consumer}"}}, true},
+		{headerRules{Remove: []string{""}}, true},
+		{headerRules{Rename: map[string]string{"X-Old": ""}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.rules.isValid(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, wantErr %v", tt.rules, err, tt.wantErr)
+		}
+	}
+}
+
+func TestHeaderTransform(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("X-Upstream-Version", "2")
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	defer echo.Close()
+
+	_config = newConfiguration()
+	transform := &headerTransform{
+		Request: &headerRules{
+			Remove: []string{"Cookie"},
+			Rename: map[string]string{"X-Old": "X-New", "X-Older": "X-New"},
+			Set:    map[string]string{"X-Consumer-Name": "{consumer.username}", "X-Path": "{method} {path}"},
+			Add:    map[string]string{"X-Tag": "user-{param.id}", "X-Agent": "{header.User-Agent}{unknown}"},
+		},
+		Response: &headerRules{
+			Remove: []string{"X-Internal"},
+			Rename: map[string]string{"X-Upstream-Version": "X-Version"},
+			Set:    map[string]string{"X-Gateway": "bifrost"},
+		},
+	}
+	if err := transform.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "users", Upstreams: []*upstream{{Name: "u1", TargetURL: echo.URL}}},
+	}, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/users/:id", Service: "users", Headers: transform},
+	})
+	gateway := newTestGateway(t, Consumer{ID: "c1", Username: "alice"}, newProxy().Invoke)
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/users/1", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Old", "old")
+	req.Header.Set("X-Older", "older")
+	req.Header.Set("X-Tag", "client")
+	req.Header.Set("User-Agent", "test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var received http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&received); err != nil {
+		t.Fatal(err)
+	}
+
+	requestTests := []struct {
+		name string
+		want []string
+	}{
+		{"Cookie", nil},
+		{"X-Old", nil},
+		// renames are applied in the order of header names, so the last one wins
+		{"X-New", []string{"older"}},
+		{"X-Consumer-Name", []string{"alice"}},
+		{"X-Path", []string{"GET /users/1"}},
+		{"X-Tag", []string{"client", "user-1"}},
+		{"X-Agent", []string{"test"}},
+	}
+	for _, tt := range requestTests {
+		if got := received[tt.name]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("request header %s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	responseTests := []struct {
+		name string
+		want string
+	}{
+		{"X-Internal", ""},
+		{"X-Upstream-Version", ""},
+		{"X-Version", "2"},
+		{"X-Gateway", "bifrost"},
+	}
+	for _, tt := range responseTests {
+		if got := resp.Header.Get(tt.name); got != tt.want {
+			t.Errorf("response header %s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	upstreamUp   = "up"
+	upstreamDown = "down"
+)
+
+type healthCheck struct {
+	Path               string `json:"path" bson:"path"`
+	Interval           int    `json:"interval" bson:"interval"` // seconds
+	Timeout            int    `json:"timeout" bson:"timeout"`   // seconds
+	HealthyThreshold   int    `json:"healthy_threshold" bson:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold" bson:"unhealthy_threshold"`
+}
+
+func (hc *healthCheck) isValid() error {
+	if len(hc.Path) == 0 || !strings.HasPrefix(hc.Path, "/") {
+		return AppError{ErrorCode: "invalid_input", Message: "health_check path field must start with /"}
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = 10
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 5
+		if hc.Timeout > hc.Interval {
+			hc.Timeout = hc.Interval
+		}
+	}
+	if hc.Timeout > hc.Interval {
+		return AppError{ErrorCode: "invalid_input", Message: "health_check timeout can't be greater than interval"}
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	return nil
+}
+
+// runHealthChecks checks upstreams of all services which enable health check in the background.  Services are
+// read from the route table, because admin api replaces the services while the checks are running.
+func runHealthChecks() {
+	for {
+		now := time.Now()
+		for _, svc := range currentRoutes().services {
+			if svc.isHealthCheckDue(now) {
+				go svc.checkUpstreams()
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func (s *service) isHealthCheckDue(now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.HealthCheck == nil || s.checking || now.Before(s.nextCheckAt) {
+		return false
+	}
+	s.checking = true
+	s.nextCheckAt = now.Add(time.Duration(s.HealthCheck.Interval) * time.Second)
+	return true
+}
+
+func (s *service) checkUpstreams() {
+	s.RLock()
+	hc := *s.HealthCheck
+	upstreams := make([]*upstream, len(s.Upstreams))
+	copy(upstreams, s.Upstreams)
+	s.RUnlock()
+
+	done := make(chan bool, len(upstreams))
+	for _, u := range upstreams {
+		go func(u *upstream) {
+			healthy := checkUpstream(u.TargetURL, hc)
+			s.reportHealth(u, healthy, hc)
+			done <- true
+		}(u)
+	}
+	for range upstreams {
+		<-done
+	}
+
+	s.Lock()
+	s.checking = false
+	s.Unlock()
+}
+
+func checkUpstream(targetURL string, hc healthCheck) bool {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(targetURL, "/")+hc.Path, nil)
+	if err != nil {
+		_logger.debugf("health check request failed: %v", err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(hc.Timeout)*time.Second)
+	defer cancel()
+
+	resp, err := _httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		_logger.debugf("health check failed: %v", err)
+		return false
+	}
+	defer respClose(resp.Body)
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// reportHealth changes the upstream state when it reaches the healthy or unhealthy threshold.
+func (s *service) reportHealth(u *upstream, healthy bool, hc healthCheck) {
+	s.Lock()
+	defer s.Unlock()
+
+	if healthy {
+		u.failures = 0
+		u.successes++
+		if u.State == upstreamDown && u.successes >= hc.HealthyThreshold {
+			u.State = upstreamUp
+			u.UpdatedAt = time.Now().UTC()
+			_logger.infof("upstream was up: %s", s.Name+"/"+u.Name)
+		}
+		return
+	}
+
+	u.successes = 0
+	u.failures++
+	if u.State != upstreamDown && u.failures >= hc.UnhealthyThreshold {
+		u.State = upstreamDown
+		u.UpdatedAt = time.Now().UTC()
+		_logger.infof("upstream was down: %s", s.Name+"/"+u.Name)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckIsValid(t *testing.T) {
+	tests := []struct {
+		hc      healthCheck
+		wantErr bool
+		want    healthCheck
+	}{
+		{healthCheck{Path: "/health"}, false, healthCheck{Path: "/health", Interval: 10, Timeout: 5, HealthyThreshold: 2, UnhealthyThreshold: 3}},
+		{healthCheck{Path: "/health", Interval: 2}, false, healthCheck{Path: "/health", Interval: 2, Timeout: 2, HealthyThreshold: 2, UnhealthyThreshold: 3}},
+		{healthCheck{Path: "health"}, true, healthCheck{}},
+		{healthCheck{Path: "/health", Interval: 2, Timeout: 3}, true, healthCheck{}},
+	}
+	for _, tt := range tests {
+		hc := tt.hc
+		err := hc.isValid()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, wantErr %v", tt.hc, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && hc != tt.want {
+			t.Errorf("%+v: got %+v, want %+v", tt.hc, hc, tt.want)
+		}
+	}
+}
+
+func TestHealthCheckIsDue(t *testing.T) {
+	svc := &service{Name: "users", HealthCheck: &healthCheck{Path: "/health", Interval: 10}}
+	now := time.Now()
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{now, true},
+		// the check is still running
+		{now.Add(time.Minute), false},
+	}
+	for i, tt := range tests {
+		if got := svc.isHealthCheckDue(tt.now); got != tt.want {
+			t.Errorf("check %d: got %v, want %v", i+1, got, tt.want)
+		}
+	}
+
+	svc.checking = false
+	if svc.isHealthCheckDue(now.Add(5 * time.Second)) {
+		t.Error("the check is due before the interval")
+	}
+	if !svc.isHealthCheckDue(now.Add(10 * time.Second)) {
+		t.Error("the check isn't due after the interval")
+	}
+	if (&service{Name: "other"}).isHealthCheckDue(now) {
+		t.Error("the service without health check is checked")
+	}
+}
+
+func TestHealthCheckMarksUpstreamDown(t *testing.T) {
+	if _httpClient == nil {
+		_httpClient = &http.Client{}
+	}
+	var healthy int32 = 1
+	newServer := func(name string, checked *int32) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				if atomic.LoadInt32(checked) == 0 {
+					w.WriteHeader(503)
+				}
+				return
+			}
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	alwaysHealthy := int32(1)
+	flaky := newServer("flaky", &healthy)
+	good := newServer("good", &alwaysHealthy)
+
+	_config = newConfiguration()
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "users", HealthCheck: &healthCheck{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 2},
+			Upstreams: []*upstream{{Name: "flaky", TargetURL: flaky.URL}, {Name: "good", TargetURL: good.URL}}},
+	}, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/users", Service: "users"},
+	})
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+	svc := currentRoutes().service("users")
+
+	responses := func() map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < 6; i++ {
+			_, body := getBody(t, gateway.URL+"/users")
+			counts[body]++
+		}
+		return counts
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	tests := []struct {
+		healthy   int32
+		wantState string
+	}{
+		// the thresholds must be reached before the state changes
+		{0, ""},
+		{0, upstreamDown},
+		{1, upstreamDown},
+		{1, upstreamUp},
+	}
+	for i, tt := range tests {
+		atomic.StoreInt32(&healthy, tt.healthy)
+		svc.checkUpstreams()
+		if state := svc.snapshot().Upstreams[0].State; state != tt.wantState {
+			t.Fatalf("check %d: state = %q, want %q", i+1, state, tt.wantState)
+		}
+		counts := responses()
+		if tt.wantState == upstreamDown && counts["good"] != 6 {
+			t.Errorf("check %d: got %v, want only the good upstream", i+1, counts)
+		}
+		if tt.wantState != upstreamDown && (counts["good"] != 3 || counts["flaky"] != 3) {
+			t.Errorf("check %d: got %v, want both upstreams", i+1, counts)
+		}
+	}
+}
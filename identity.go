@@ -1,28 +1,91 @@
 package main
 
-import "github.com/jasonsoft/napnap"
+import (
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/jasonsoft/napnap"
+)
+
+// authenticator identifies the consumer of the request, it returns false when the request doesn't carry
+// its credential or the credential is invalid, so the next one can be tried.
+type authenticator func(c *napnap.Context, auth *authentication) (Consumer, bool)
+
+var _authenticators = map[string]authenticator{
+	authToken:  tokenAuthenticator,
+	authAPIKey: apiKeyAuthenticator,
+	authBasic:  basicAuthenticator,
+	authHMAC:   hmacAuthenticator,
+}
+
+// identity runs the authentication plugins of the api entry in order, the first one which identifies
+// the request wins.  The request is anonymous when no plugin identifies it.
 func identity(c *napnap.Context, next napnap.HandlerFunc) {
+	auth := defaultAuthentication
+	if apiEntry := matchedAPI(c); apiEntry != nil && apiEntry.Authentication != nil {
+		auth = apiEntry.Authentication
+	}
+
+	for _, plugin := range auth.Plugins {
+		authenticate := _authenticators[plugin]
+		if authenticate == nil {
+			continue
+		}
+		consumer, ok := authenticate(c, auth)
+		if ok {
+			_logger.debugf("consumer id: %v", consumer.ID)
+			c.Set("consumer", consumer)
+			next(c)
+			return
+		}
+	}
+
+	_logger.debug("consumer was not identified")
+	c.Set("consumer", Consumer{})
+	next(c)
+}
+
+// authorization ensures the consumer has access permission of the matched api entry.  It runs before rate limit,
+// so the requests which are rejected don't spend the tokens of api entry.
+func authorization(c *napnap.Context, next napnap.HandlerFunc) {
+	apiEntry := matchedAPI(c)
+	consumer := c.MustGet("consumer").(Consumer)
+	if apiEntry != nil && apiEntry.isAllow(consumer, c.Request) == false {
+		if consumer.isAuthenticated() {
+			c.SetStatus(403)
+			return
+		}
+		c.SetStatus(401)
+		return
+	}
+	next(c)
+}
+
+// tokenAuthenticator looks up the Authorization header in token repository, signed JWTs are verified
+// without repository when jwt is enabled.
+func tokenAuthenticator(c *napnap.Context, auth *authentication) (Consumer, bool) {
 	key := c.Request.Header.Get("Authorization")
-	var consumer Consumer
 	if len(key) == 0 {
-		consumer = Consumer{}
 		_logger.debug("no key")
-		c.Set("consumer", consumer)
-		next(c)
-		return
+		return Consumer{}, false
+	}
+	if strings.HasPrefix(key, "Basic ") || strings.HasPrefix(key, hmacScheme+" ") {
+		return Consumer{}, false
 	}
 
+	if _config.JWT.Enable && isJWT(strings.TrimPrefix(key, "Bearer ")) {
+		return identityJWT(c, strings.TrimPrefix(key, "Bearer "))
+	}
+
+	key = strings.TrimPrefix(key, "Bearer ")
 	token, err := _tokenRepo.Get(key)
 	if err != nil {
 		panic(err)
 	}
-	if token == nil {
-		consumer = Consumer{}
+	if token == nil || token.Type == tokenTypeRefresh {
 		_logger.debug("key was not found")
-		c.Set("consumer", consumer)
-		next(c)
-		return
+		return Consumer{}, false
 	}
 
 	if token.isValid() == false {
@@ -30,23 +93,17 @@ func identity(c *napnap.Context, next napnap.HandlerFunc) {
 		if err != nil {
 			panic(err)
 		}
-		consumer = Consumer{}
 		_logger.debug("key has expired")
-		c.Set("consumer", consumer)
-		next(c)
-		return
+		return Consumer{}, false
 	}
 
 	// verify client's ip which must be the same as token's ip address.
 	if _config.Token.VerifyIP {
-		clientIP := getClientIP(c.RemoteIPAddress())
+		clientIP := getClientIP(c.Request)
 		_logger.debugf("consumer ip: %v", clientIP)
 		if len(token.IPAddress) > 0 && token.IPAddress != clientIP {
-			consumer = Consumer{}
 			_logger.debug("token didn't match client ip")
-			c.Set("consumer", consumer)
-			next(c)
-			return
+			return Consumer{}, false
 		}
 	}
 
@@ -55,11 +112,8 @@ func identity(c *napnap.Context, next napnap.HandlerFunc) {
 		panic(err)
 	}
 	if target == nil {
-		consumer = Consumer{}
 		_logger.debug("consumer was not found")
-		c.Set("consumer", consumer)
-		next(c)
-		return
+		return Consumer{}, false
 	}
 
 	// extend token's life
@@ -68,9 +122,77 @@ func identity(c *napnap.Context, next napnap.HandlerFunc) {
 		_tokenRepo.Update(token)
 	}
 
-	consumer = *(target)
-	_logger.debugf("consumer id: %v", consumer.ID)
-	c.Set("consumer", consumer)
+	consumer := *(target)
+	consumer.Scopes = token.Scopes
 	c.Set("token", key)
-	next(c)
+	return consumer, true
+}
+
+// identityJWT maps the claims of a signed JWT onto consumer without looking up the token repository.
+func identityJWT(c *napnap.Context, token string) (Consumer, bool) {
+	claims, err := _jwtKeys.parseJWT(token, _config.JWT)
+	if err != nil {
+		_logger.debugf("jwt was invalid: %v", err)
+		return Consumer{}, false
+	}
+
+	c.Set("token", token)
+	return claims.consumer(_config.JWT.Claims), true
+}
+
+// takeAPIKey returns the api key of the request and removes it, so it won't be sent to upstream.
+func takeAPIKey(req *http.Request) string {
+	setting := _config.APIKey
+	if len(setting.Header) > 0 {
+		if key := req.Header.Get(setting.Header); len(key) > 0 {
+			req.Header.Del(setting.Header)
+			return key
+		}
+	}
+	if len(setting.QueryParam) > 0 {
+		query := req.URL.Query()
+		if key := query.Get(setting.QueryParam); len(key) > 0 {
+			query.Del(setting.QueryParam)
+			req.URL.RawQuery = query.Encode()
+			return key
+		}
+	}
+	return ""
+}
+
+func apiKeyAuthenticator(c *napnap.Context, auth *authentication) (Consumer, bool) {
+	key := takeAPIKey(c.Request)
+	if len(key) == 0 {
+		return Consumer{}, false
+	}
+
+	apiKey, err := _apiKeyRepo.GetByHash(hashAPIKey(key))
+	if err != nil {
+		panic(err)
+	}
+	if apiKey == nil {
+		_logger.debug("api key was not found")
+		return Consumer{}, false
+	}
+
+	target, err := _consumerRepo.Get(apiKey.ConsumerID)
+	if err != nil {
+		panic(err)
+	}
+	if target == nil {
+		_logger.debug("consumer was not found")
+		return Consumer{}, false
+	}
+
+	now := time.Now().UTC()
+	if apiKey.shouldTouch(now) {
+		err = _apiKeyRepo.UpdateLastUsed(apiKey.ID, now)
+		if err != nil {
+			_logger.errorf("api key last used time was not updated: %v", err)
+		}
+	}
+
+	consumer := *(target)
+	consumer.Scopes = apiKey.Scopes
+	return consumer, true
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// IPRestrictionSetting is the CIDR based allow and deny lists which are configured globally and per api entry.
+// Deny list is checked first, the request is denied when the allow list is set and the client ip isn't in it.
+type IPRestrictionSetting struct {
+	Allow     []string `yaml:"allow" json:"allow,omitempty" bson:"allow,omitempty"`
+	Deny      []string `yaml:"deny" json:"deny,omitempty" bson:"deny,omitempty"`
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+func (r *IPRestrictionSetting) isValid() error {
+	allowNets, err := parseIPNets(r.Allow)
+	if err != nil {
+		return AppError{ErrorCode: "invalid_input", Message: "allow of ip_restriction is invalid: " + err.Error()}
+	}
+	denyNets, err := parseIPNets(r.Deny)
+	if err != nil {
+		return AppError{ErrorCode: "invalid_input", Message: "deny of ip_restriction is invalid: " + err.Error()}
+	}
+	r.allowNets = allowNets
+	r.denyNets = denyNets
+	return nil
+}
+
+// check returns whether the client ip is allowed and the reason when it is denied.
+func (r *IPRestrictionSetting) check(clientIP string) (bool, string) {
+	if r == nil {
+		return true, ""
+	}
+	if len(r.denyNets) > 0 && containsIP(r.denyNets, clientIP) {
+		return false, "deny list"
+	}
+	if len(r.allowNets) > 0 && !containsIP(r.allowNets, clientIP) {
+		return false, "allow list"
+	}
+	return true, ""
+}
+
+// ipRestrictionMiddleware checks the real client ip against the global lists and then the lists of matched api entry,
+// it runs before identity, so the denied requests never touch the repositories.  The forwarding headers are ignored
+// unless trusted_proxies is set.
+func ipRestrictionMiddleware(c *napnap.Context, next napnap.HandlerFunc) {
+	clientIP := getAccessControlIP(c.Request)
+
+	allowed, reason := _config.IPRestriction.check(clientIP)
+	if !allowed {
+		reason = "global " + reason
+	} else if apiEntry := matchedAPI(c); apiEntry != nil {
+		allowed, reason = apiEntry.IPRestriction.check(clientIP)
+		if !allowed {
+			reason = "api " + apiEntry.Name + " " + reason
+		}
+	}
+
+	if !allowed {
+		_logger.debugf("client ip was denied: %s", clientIP+" by "+reason)
+		c.Set("ip_restriction", "denied by "+reason)
+		c.JSON(403, AppError{ErrorCode: "forbidden", Message: "Your ip address is not allowed."})
+		return
+	}
+	next(c)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestIPRestrictionIsValid(t *testing.T) {
+	tests := []struct {
+		setting IPRestrictionSetting
+		wantErr bool
+	}{
+		{IPRestrictionSetting{}, false},
+		{IPRestrictionSetting{Allow: []string{"10.0.0.0/8", "127.0.0.1", "::1"}}, false},
+		{IPRestrictionSetting{Deny: []string{"2001:db8::/32"}}, false},
+		{IPRestrictionSetting{Allow: []string{"10.0.0.0/33"}}, true},
+		{IPRestrictionSetting{Deny: []string{"example.com"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.setting.isValid(); (err != nil) != tt.wantErr {
+			t.Errorf("allow %v, deny %v: err = %v, wantErr %v", tt.setting.Allow, tt.setting.Deny, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIPRestrictionMiddleware(t *testing.T) {
+	_config = newConfiguration()
+	_config.TrustedProxies = []string{"127.0.0.1"}
+	_config.IPRestriction = &IPRestrictionSetting{Deny: []string{"1.1.1.0/24"}}
+	if err := _config.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	admin := &api{Name: "admin", RequestHost: "*", RequestPath: "/admin",
+		IPRestriction: &IPRestrictionSetting{Allow: []string{"2.2.0.0/16"}, Deny: []string{"2.2.2.2"}}}
+	if err := admin.IPRestriction.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	setupTestRoutes(t, nil, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/users"},
+		admin,
+	})
+	ok := func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.SetStatus(200)
+	}
+	gateway := newTestGateway(t, Consumer{}, ipRestrictionMiddleware, ok)
+
+	tests := []struct {
+		path         string
+		forwardedFor string
+		want         int
+	}{
+		{"/users", "3.3.3.3", 200},
+		{"/users", "1.1.1.1", 403},
+		// the global deny list wins over the allow list of api entry
+		{"/admin", "1.1.1.1", 403},
+		{"/admin", "2.2.1.1", 200},
+		{"/admin", "2.2.2.2", 403},
+		{"/admin", "3.3.3.3", 403},
+		// the address of a proxy which isn't trusted is checked
+		{"/users", "3.3.3.3, 1.1.1.1", 403},
+		{"/admin", "1.1.1.1, 2.2.1.1", 200},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", gateway.URL+tt.path, nil)
+		req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s from %s: got %d, want %d", tt.path, tt.forwardedFor, resp.StatusCode, tt.want)
+		}
+	}
+	_config = newConfiguration()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func mustJSONSchema(t *testing.T, document string) *jsonSchema {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := newJSONSchema(doc)
+	if err != nil {
+		t.Fatalf("%s: %v", document, err)
+	}
+	return schema
+}
+
+func TestNewJSONSchemaError(t *testing.T) {
+	tests := []string{
+		`{"type": "map"}`,
+		`{"type": 1}`,
+		`{"pattern": "("}`,
+		`{"properties": {"name": {"type": "text"}}}`,
+		`{"items": {"pattern": "["}}`,
+		`{"minLength": "1"}`,
+	}
+	for _, document := range tests {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(document), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newJSONSchema(doc); err == nil {
+			t.Errorf("%s: expected error", document)
+		}
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	user := `{
+		"type": "object",
+		"required": ["name"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 2, "maxLength": 5, "pattern": "^[a-z]+$"},
+			"age": {"type": "integer", "minimum": 0, "maximum": 150},
+			"role": {"enum": ["admin", "member"]},
+			"version": {"const": 1},
+			"nickname": {"type": ["string", "null"]},
+			"tags": {"type": "array", "minItems": 1, "maxItems": 2, "items": {"type": "string"}}
+		}
+	}`
+
+	tests := []struct {
+		schema string
+		body   string
+		want   string
+	}{
+		{user, `{"name": "bob"}`, ""},
+		{user, `{"name": "bob", "age": 20, "role": "admin", "version": 1, "nickname": null, "tags": ["a", "b"]}`, ""},
+		{user, `[]`, "$ must be object"},
+		{user, `{}`, "$.name is required"},
+		{user, `{"name": "bob", "email": "bob@example.com"}`, "$.email is not allowed"},
+		{user, `{"name": "b"}`, "$.name must be at least 2 characters"},
+		{user, `{"name": "bobbie"}`, "$.name must be at most 5 characters"},
+		{user, `{"name": "Bob"}`, "$.name must match pattern ^[a-z]+$"},
+		{user, `{"name": 1}`, "$.name must be string"},
+		{user, `{"name": "bob", "age": 1.5}`, "$.age must be integer"},
+		{user, `{"name": "bob", "age": -1}`, "$.age must be greater than or equal to 0"},
+		{user, `{"name": "bob", "age": 151}`, "$.age must be less than or equal to 150"},
+		{user, `{"name": "bob", "role": "owner"}`, "$.role must be one of the enum values"},
+		{user, `{"name": "bob", "version": 2}`, "$.version must be the const value"},
+		{user, `{"name": "bob", "nickname": 1}`, "$.nickname must be string or null"},
+		{user, `{"name": "bob", "tags": []}`, "$.tags must have at least 1 items"},
+		{user, `{"name": "bob", "tags": ["a", "b", "c"]}`, "$.tags must have at most 2 items"},
+		{user, `{"name": "bob", "tags": ["a", 1]}`, "$.tags[1] must be string"},
+		// the properties are checked in order of name
+		{user, `{"name": 1, "age": -1}`, "$.age must be greater than or equal to 0"},
+		// multibyte characters are counted once
+		{`{"type": "string", "maxLength": 2}`, `"日本"`, ""},
+		{`{"type": "number"}`, `1.5`, ""},
+		{`{"type": "boolean"}`, `true`, ""},
+		{`{"type": "null"}`, `false`, "$ must be null"},
+		{`{}`, `{"anything": [1, "a"]}`, ""},
+	}
+	for _, tt := range tests {
+		schema := mustJSONSchema(t, tt.schema)
+		var body interface{}
+		if err := json.Unmarshal([]byte(tt.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if err := schema.validate(body, "$"); err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+	"github.com/satori/go.uuid"
+)
+
+var (
+	ErrJWTMalformed = errors.New("jwt: token is malformed")
+	ErrJWTKey       = errors.New("jwt: signing key was not found")
+	ErrJWTSignature = errors.New("jwt: signature is invalid")
+	ErrJWTExpired   = errors.New("jwt: token has expired")
+	ErrJWTNoExpiry  = errors.New("jwt: exp claim is required")
+	ErrJWTNotBefore = errors.New("jwt: token is not valid yet")
+	ErrJWTIssuer    = errors.New("jwt: issuer is invalid")
+	ErrJWTAudience  = errors.New("jwt: audience is invalid")
+	ErrJWTSigning   = errors.New("jwt: signing key is not configured")
+)
+
+// minJWTSecretLength is the shortest HS256 secret, anyone can forge tokens which are signed by a short or empty secret.
+const minJWTSecretLength = 32
+
+const (
+	jwtHS256 = "HS256"
+	jwtRS256 = "RS256"
+	jwtES256 = "ES256"
+)
+
+type jwtKey struct {
+	id        string
+	algorithm string
+	secret    []byte
+	rsaKey    *rsa.PublicKey
+	ecKey     *ecdsa.PublicKey
+	// privateKey is *rsa.PrivateKey or *ecdsa.PrivateKey, it is only loaded for signing
+	privateKey crypto.Signer
+}
+
+type jwtKeySet struct {
+	keys []*jwtKey
+}
+
+// loadJWTKeys loads the verification keys from the configuration and the local JWKS file.
+func loadJWTKeys(setting JWTSetting) (*jwtKeySet, error) {
+	keySet := &jwtKeySet{}
+	for _, k := range setting.Keys {
+		key := &jwtKey{
+			id:        k.ID,
+			algorithm: k.Algorithm,
+		}
+		switch k.Algorithm {
+		case jwtHS256:
+			key.secret = []byte(k.Secret)
+		case jwtRS256, jwtES256:
+			var publicKey crypto.PublicKey
+			if len(k.PrivateKeyFile) > 0 {
+				data, err := ioutil.ReadFile(k.PrivateKeyFile)
+				if err != nil {
+					return nil, err
+				}
+				key.privateKey, err = parsePrivateKeyPEM(data)
+				if err != nil {
+					return nil, err
+				}
+				publicKey = key.privateKey.Public()
+			}
+			if len(k.PublicKeyFile) > 0 {
+				data, err := ioutil.ReadFile(k.PublicKeyFile)
+				if err != nil {
+					return nil, err
+				}
+				publicKey, err = parsePublicKeyPEM(data)
+				if err != nil {
+					return nil, err
+				}
+			}
+			switch pub := publicKey.(type) {
+			case *rsa.PublicKey:
+				key.rsaKey = pub
+			case *ecdsa.PublicKey:
+				key.ecKey = pub
+			}
+		}
+		keySet.keys = append(keySet.keys, key)
+	}
+
+	if len(setting.JWKSFile) > 0 {
+		data, err := ioutil.ReadFile(setting.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		keySet.keys = append(keySet.keys, keys...)
+	}
+	return keySet, nil
+}
+
+func parsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt: public key must be PEM encoded")
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return cert.PublicKey, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt: private key must be PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("jwt: private key type is not supported")
+	}
+	return signer, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	K   string `json:"k,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jsonWebKeySet struct {
+	Keys []*jsonWebKey `json:"keys"`
+}
+
+func parseJWKS(data []byte) ([]*jwtKey, error) {
+	var jwks jsonWebKeySet
+	err := json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*jwtKey{}
+	for _, jwk := range jwks.Keys {
+		key := &jwtKey{
+			id:        jwk.Kid,
+			algorithm: jwk.Alg,
+		}
+		switch jwk.Kty {
+		case "oct":
+			key.secret, err = base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil {
+				return nil, err
+			}
+			if len(key.secret) < minJWTSecretLength {
+				return nil, errors.New("jwt: secret of oct key must be at least 32 bytes")
+			}
+			key.algorithm = jwtHS256
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err != nil {
+				return nil, err
+			}
+			key.rsaKey = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+			key.algorithm = jwtRS256
+		case "EC":
+			if jwk.Crv != "P-256" {
+				// only ES256 is supported
+				continue
+			}
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err != nil {
+				return nil, err
+			}
+			key.ecKey = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+			key.algorithm = jwtES256
+		default:
+			continue
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// find returns the key which matches the key id and algorithm of the token header.
+func (ks *jwtKeySet) find(kid, algorithm string) *jwtKey {
+	for _, key := range ks.keys {
+		if key.algorithm != algorithm {
+			continue
+		}
+		if len(kid) > 0 && len(key.id) > 0 && key.id != kid {
+			continue
+		}
+		return key
+	}
+	return nil
+}
+
+func (k *jwtKey) verify(signingInput string, signature []byte) bool {
+	hash := sha256.Sum256([]byte(signingInput))
+	switch k.algorithm {
+	case jwtHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(signature, mac.Sum(nil))
+	case jwtRS256:
+		if k.rsaKey == nil {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(k.rsaKey, crypto.SHA256, hash[:], signature) == nil
+	case jwtES256:
+		if k.ecKey == nil || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k.ecKey, hash[:], r, s)
+	}
+	return false
+}
+
+func (k *jwtKey) sign(signingInput string) ([]byte, error) {
+	hash := sha256.Sum256([]byte(signingInput))
+	switch k.algorithm {
+	case jwtHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signingInput))
+		return mac.Sum(nil), nil
+	case jwtRS256:
+		privateKey, ok := k.privateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, ErrJWTSigning
+		}
+		return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+	case jwtES256:
+		privateKey, ok := k.privateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, ErrJWTSigning
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, privateKey, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		// the signature is r and s in fixed 32 bytes
+		signature := make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+		return signature, nil
+	}
+	return nil, ErrJWTSigning
+}
+
+// signingKey returns the key which is used to issue tokens.
+func (ks *jwtKeySet) signingKey(id string) *jwtKey {
+	if ks == nil || len(id) == 0 {
+		return nil
+	}
+	for _, key := range ks.keys {
+		if key.id != id {
+			continue
+		}
+		if key.algorithm != jwtHS256 && key.privateKey == nil {
+			return nil
+		}
+		return key
+	}
+	return nil
+}
+
+// newJWT issues a signed token which carries the consumer as claims.
+func (ks *jwtKeySet) newJWT(consumer *Consumer, expiration time.Time, setting JWTSetting) (string, error) {
+	key := ks.signingKey(setting.SigningKey)
+	if key == nil {
+		return "", ErrJWTSigning
+	}
+
+	now := time.Now().UTC()
+	claims := jwtClaims{
+		"jti": uuid.NewV4().String(),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": expiration.Unix(),
+	}
+	if len(setting.Issuer) > 0 {
+		claims["iss"] = setting.Issuer
+	}
+	if len(setting.Audience) > 0 {
+		claims["aud"] = setting.Audience
+	}
+	claims[setting.Claims.ConsumerID] = consumer.ID
+	if len(consumer.App) > 0 {
+		claims[setting.Claims.App] = consumer.App
+	}
+	if len(consumer.Roles) > 0 {
+		claims[setting.Claims.Roles] = consumer.Roles
+	}
+	if len(consumer.CustomFields) > 0 {
+		claims[setting.Claims.CustomFields] = consumer.CustomFields
+	}
+
+	header, err := json.Marshal(jwtHeader{Alg: key.algorithm, Kid: key.id, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := key.sign(signingInput)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// jwks returns the public keys, the shared secrets of HS256 are never exposed.
+func (ks *jwtKeySet) jwks() *jsonWebKeySet {
+	result := &jsonWebKeySet{
+		Keys: []*jsonWebKey{},
+	}
+	if ks == nil {
+		return result
+	}
+	for _, key := range ks.keys {
+		switch {
+		case key.rsaKey != nil:
+			result.Keys = append(result.Keys, &jsonWebKey{
+				Kty: "RSA",
+				Kid: key.id,
+				Alg: jwtRS256,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.rsaKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.rsaKey.E)).Bytes()),
+			})
+		case key.ecKey != nil:
+			result.Keys = append(result.Keys, &jsonWebKey{
+				Kty: "EC",
+				Kid: key.id,
+				Alg: jwtES256,
+				Use: "sig",
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(padBytes(key.ecKey.X.Bytes(), 32)),
+				Y:   base64.RawURLEncoding.EncodeToString(padBytes(key.ecKey.Y.Bytes(), 32)),
+			})
+		}
+	}
+	return result
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	result := make([]byte, size)
+	copy(result[size-len(b):], b)
+	return result
+}
+
+// jwksMiddleware serves the public keys on the admin port without admin token,
+// so downstream services can verify the issued tokens themselves.
+func jwksMiddleware(c *napnap.Context, next napnap.HandlerFunc) {
+	if c.Request.Method != "GET" || c.Request.URL.Path != "/.well-known/jwks.json" {
+		next(c)
+		return
+	}
+	c.JSON(200, _jwtKeys.jwks())
+}
+
+// isJWT reports whether the authorization value looks like a JWT instead of an opaque token.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type jwtClaims map[string]interface{}
+
+// parseJWT verifies the signature and the registered claims of the token and returns its claims.
+func (ks *jwtKeySet) parseJWT(token string, setting JWTSetting) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	key := ks.find(header.Kid, header.Alg)
+	if key == nil {
+		return nil, ErrJWTKey
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	if !key.verify(parts[0]+"."+parts[1], signature) {
+		return nil, ErrJWTSignature
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, ErrJWTMalformed
+	}
+
+	// tokens without exp would be valid forever
+	now := time.Now().UTC().Unix()
+	exp, ok := claims.number("exp")
+	if !ok {
+		return nil, ErrJWTNoExpiry
+	}
+	if now > exp+setting.Leeway {
+		return nil, ErrJWTExpired
+	}
+	if nbf, ok := claims.number("nbf"); ok && now < nbf-setting.Leeway {
+		return nil, ErrJWTNotBefore
+	}
+	if len(setting.Issuer) > 0 && claims.str("iss") != setting.Issuer {
+		return nil, ErrJWTIssuer
+	}
+	if len(setting.Audience) > 0 && !contains(claims.strs("aud"), setting.Audience) {
+		return nil, ErrJWTAudience
+	}
+	return claims, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c jwtClaims) number(name string) (int64, bool) {
+	val, ok := c[name].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int64(val), true
+}
+
+func (c jwtClaims) str(name string) string {
+	val, _ := c[name].(string)
+	return val
+}
+
+// strs returns the claim which may be a string or an array of string, e.g. aud.
+func (c jwtClaims) strs(name string) []string {
+	switch val := c[name].(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		result := []string{}
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// consumer maps the claims onto a consumer.
+func (c jwtClaims) consumer(mapping JWTClaimSetting) Consumer {
+	consumer := Consumer{
+		ID:    c.str(mapping.ConsumerID),
+		App:   c.str(mapping.App),
+		Roles: c.strs(mapping.Roles),
+		// scope is space separated, RFC 8693
+		Scopes: strings.Fields(c.str("scope")),
+	}
+	if fields, ok := c[mapping.CustomFields].(map[string]interface{}); ok {
+		consumer.CustomFields = map[string]string{}
+		for key, val := range fields {
+			if s, ok := val.(string); ok {
+				consumer.CustomFields[key] = s
+			}
+		}
+	}
+	return consumer
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func newTestJWTKeySet(t *testing.T) *jwtKeySet {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwtKeySet{
+		keys: []*jwtKey{
+			{id: "hs", algorithm: jwtHS256, secret: []byte("0123456789abcdef0123456789abcdef")},
+			{id: "es", algorithm: jwtES256, ecKey: &ecKey.PublicKey, privateKey: ecKey},
+			{id: "rs", algorithm: jwtRS256, rsaKey: &rsaKey.PublicKey, privateKey: rsaKey},
+		},
+	}
+}
+
+// newTestJWT signs the header and claims with the key, the header is sent as it is.
+func newTestJWT(t *testing.T, key *jwtKey, header jwtHeader, claims jwtClaims) string {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	signature, err := key.sign(signingInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestParseJWT(t *testing.T) {
+	ks := newTestJWTKeySet(t)
+	hs, es, rs := ks.keys[0], ks.keys[1], ks.keys[2]
+	now := time.Now().Unix()
+	setting := JWTSetting{Issuer: "bifrost", Audience: "api", Leeway: 30}
+	valid := func() jwtClaims {
+		return jwtClaims{"sub": "c1", "iss": "bifrost", "aud": "api", "exp": now + 60, "nbf": now}
+	}
+	with := func(name string, value interface{}) jwtClaims {
+		claims := valid()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	tampered := newTestJWT(t, hs, jwtHeader{Alg: jwtHS256, Kid: "hs"}, valid())
+	if tampered[len(tampered)-3] == 'A' {
+		tampered = tampered[:len(tampered)-3] + "B" + tampered[len(tampered)-2:]
+	} else {
+		tampered = tampered[:len(tampered)-3] + "A" + tampered[len(tampered)-2:]
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"HS256", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256, Kid: "hs"}, valid()), nil},
+		{"ES256", newTestJWT(t, es, jwtHeader{Alg: jwtES256, Kid: "es"}, valid()), nil},
+		{"RS256", newTestJWT(t, rs, jwtHeader{Alg: jwtRS256, Kid: "rs"}, valid()), nil},
+		{"without kid", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, valid()), nil},
+		{"audience array", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("aud", []string{"web", "api"})), nil},
+		{"without nbf", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("nbf", nil)), nil},
+		{"without exp", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("exp", nil)), ErrJWTNoExpiry},
+		{"expired in leeway", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("exp", now-10)), nil},
+		{"expired", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("exp", now-60)), ErrJWTExpired},
+		{"not before in leeway", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("nbf", now+10)), nil},
+		{"not before", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("nbf", now+60)), ErrJWTNotBefore},
+		{"issuer", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("iss", "other")), ErrJWTIssuer},
+		{"missing issuer", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("iss", nil)), ErrJWTIssuer},
+		{"audience", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, with("aud", []string{"web"})), ErrJWTAudience},
+		{"unknown kid", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256, Kid: "other"}, valid()), ErrJWTKey},
+		{"algorithm of other key", newTestJWT(t, hs, jwtHeader{Alg: jwtRS256, Kid: "hs"}, valid()), ErrJWTKey},
+		{"none algorithm", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + ".e30.", ErrJWTKey},
+		{"signed by other key", newTestJWT(t, &jwtKey{algorithm: jwtHS256, secret: []byte("fedcba9876543210fedcba9876543210")}, jwtHeader{Alg: jwtHS256}, valid()), ErrJWTSignature},
+		{"tampered signature", tampered, ErrJWTSignature},
+		{"two segments", "a.b", ErrJWTMalformed},
+		{"header isn't base64", "!!.e30.sig", ErrJWTMalformed},
+		{"signature isn't base64", newTestJWT(t, hs, jwtHeader{Alg: jwtHS256}, valid()) + "!", ErrJWTMalformed},
+	}
+	for _, tt := range tests {
+		claims, err := ks.parseJWT(tt.token, setting)
+		if err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err == nil && claims.str("sub") != "c1" {
+			t.Errorf("%s: sub = %q, want c1", tt.name, claims.str("sub"))
+		}
+	}
+}
+
+func TestNewJWT(t *testing.T) {
+	ks := newTestJWTKeySet(t)
+	setting := newConfiguration().JWT
+	setting.Issuer = "bifrost"
+	setting.Audience = "api"
+	consumer := &Consumer{ID: "c1", App: "web", Roles: []string{"admin"}, CustomFields: map[string]string{"tier": "gold"}}
+
+	for _, signingKey := range []string{"hs", "es", "rs"} {
+		setting.SigningKey = signingKey
+		token, err := ks.newJWT(consumer, time.Now().Add(time.Minute), setting)
+		if err != nil {
+			t.Fatalf("%s: %v", signingKey, err)
+		}
+		claims, err := ks.parseJWT(token, setting)
+		if err != nil {
+			t.Fatalf("%s: %v", signingKey, err)
+		}
+		got := claims.consumer(setting.Claims)
+		if got.ID != consumer.ID || got.App != consumer.App || !reflect.DeepEqual(got.Roles, consumer.Roles) || !reflect.DeepEqual(got.CustomFields, consumer.CustomFields) {
+			t.Errorf("%s: got %+v, want %+v", signingKey, got, consumer)
+		}
+	}
+
+	setting.SigningKey = "unknown"
+	if _, err := ks.newJWT(consumer, time.Now().Add(time.Minute), setting); err != ErrJWTSigning {
+		t.Errorf("unknown signing key: err = %v, want %v", err, ErrJWTSigning)
+	}
+}
+
+func TestJWTClaimsConsumer(t *testing.T) {
+	mapping := newConfiguration().JWT.Claims
+	tests := []struct {
+		claims jwtClaims
+		want   Consumer
+	}{
+		{jwtClaims{}, Consumer{}},
+		{jwtClaims{"sub": "c1", "app": "web", "roles": "admin"}, Consumer{ID: "c1", App: "web", Roles: []string{"admin"}}},
+		{jwtClaims{"roles": []interface{}{"admin", 1, "member"}}, Consumer{Roles: []string{"admin", "member"}}},
+		{jwtClaims{"scope": "read  write"}, Consumer{Scopes: []string{"read", "write"}}},
+		{jwtClaims{"custom_fields": map[string]interface{}{"tier": "gold", "level": 1}}, Consumer{CustomFields: map[string]string{"tier": "gold"}}},
+		{jwtClaims{"sub": 1}, Consumer{}},
+	}
+	for _, tt := range tests {
+		got := tt.claims.consumer(mapping)
+		// nil and empty collections are the same for the consumer
+		if got.ID != tt.want.ID || got.App != tt.want.App || fmt.Sprint(got.Roles) != fmt.Sprint(tt.want.Roles) ||
+			fmt.Sprint(got.Scopes) != fmt.Sprint(tt.want.Scopes) || fmt.Sprint(got.CustomFields) != fmt.Sprint(tt.want.CustomFields) {
+			t.Errorf("%v: got %+v, want %+v", tt.claims, got, tt.want)
+		}
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	ks := newTestJWTKeySet(t)
+	data, err := json.Marshal(ks.jwks())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the published keys verify the tokens, the shared secret is never published
+	keys, err := parseJWKS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	published := &jwtKeySet{keys: keys}
+	for _, key := range ks.keys[1:] {
+		token := newTestJWT(t, key, jwtHeader{Alg: key.algorithm, Kid: key.id}, jwtClaims{"sub": "c1", "exp": time.Now().Unix() + 60})
+		if _, err := published.parseJWT(token, JWTSetting{}); err != nil {
+			t.Errorf("%s: %v", key.id, err)
+		}
+	}
+}
+
+func TestParseJWKSSecretLength(t *testing.T) {
+	tests := []struct {
+		secret  string
+		wantErr bool
+	}{
+		{"", true},
+		{"short", true},
+		{"0123456789abcdef0123456789abcde", true},
+		{"0123456789abcdef0123456789abcdef", false},
+	}
+	for _, tt := range tests {
+		data := `{"keys": [{"kty": "oct", "k": "` + base64.RawURLEncoding.EncodeToString([]byte(tt.secret)) + `"}]}`
+		if _, err := parseJWKS([]byte(data)); (err != nil) != tt.wantErr {
+			t.Errorf("secret of %d bytes: err = %v, wantErr %v", len(tt.secret), err, tt.wantErr)
+		}
+	}
+}
+
+func TestTokenEndpointIssuesJWT(t *testing.T) {
+	_config = newConfiguration()
+	_config.JWT.Enable = true
+	_config.JWT.Issuer = "bifrost"
+	_config.JWT.SigningKey = "rs"
+	oldKeys := _jwtKeys
+	_jwtKeys = newTestJWTKeySet(t)
+	t.Cleanup(func() { _jwtKeys = oldKeys })
+	_consumerRepo = newConsumerMemStore()
+	_tokenRepo = newTokenMemStore()
+	consumer := &Consumer{App: "web", Username: "alice", Roles: []string{"member"}}
+	if err := _consumerRepo.Insert(consumer); err != nil {
+		t.Fatal(err)
+	}
+
+	router := napnap.NewRouter()
+	router.Post("/v1/tokens", createTokenEndpoint)
+	admin := newTestAdmin(t, router)
+	nap := napnap.New()
+	nap.UseFunc(jwksMiddleware)
+	nap.UseFunc(notFound)
+	jwks := httptest.NewServer(nap)
+	defer jwks.Close()
+
+	setupTestRoutes(t, nil, []*api{{Name: "users", RequestHost: "*", RequestPath: "/users"}})
+	whoami := func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.String(200, c.MustGet("consumer").(Consumer).ID)
+	}
+	gateway := newTestGateway(t, Consumer{}, identity, whoami)
+
+	// downstream services verify the issued tokens with the published keys
+	status, body := getBody(t, jwks.URL+"/.well-known/jwks.json")
+	if status != 200 {
+		t.Fatalf("jwks: got %d %s", status, body)
+	}
+	keys, err := parseJWKS([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := &jwtKeySet{keys: keys}
+
+	tests := []struct {
+		format     string
+		signingKey string
+		wantStatus int
+		wantJWT    bool
+		wantStored bool
+	}{
+		{"jwt", "rs", 201, true, false},
+		{"both", "es", 201, true, true},
+		{"", "rs", 201, false, true},
+		{"other", "rs", 400, false, false},
+		// the shared secret isn't published, but tokens can still be signed with it
+		{"jwt", "hs", 201, true, false},
+		{"jwt", "unknown", 400, false, false},
+	}
+	for _, tt := range tests {
+		_config.JWT.SigningKey = tt.signingKey
+		id := "token-" + tt.format + "-" + tt.signingKey
+		resp, err := http.Post(admin.URL+"/v1/tokens", "application/json",
+			strings.NewReader(`{"id": "`+id+`", "consumer_id": "`+consumer.ID+`", "format": "`+tt.format+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s signed with %s: got %d %s, want %d", tt.format, tt.signingKey, resp.StatusCode, data, tt.wantStatus)
+			continue
+		}
+		var token Token
+		json.Unmarshal(data, &token)
+		if isJWT(token.AccessToken) != tt.wantJWT {
+			t.Errorf("%s signed with %s: got access token %q", tt.format, tt.signingKey, token.AccessToken)
+			continue
+		}
+		stored, _ := _tokenRepo.Get(id)
+		if (stored != nil) != tt.wantStored {
+			t.Errorf("%s signed with %s: token was stored %v, want %v", tt.format, tt.signingKey, stored != nil, tt.wantStored)
+		}
+		if !tt.wantJWT {
+			continue
+		}
+
+		if tt.signingKey != "hs" {
+			claims, err := published.parseJWT(token.AccessToken, _config.JWT)
+			if err != nil || claims.str("sub") != consumer.ID || claims.str("iss") != "bifrost" {
+				t.Errorf("%s signed with %s: got claims %v, %v", tt.format, tt.signingKey, claims, err)
+			}
+		}
+		req, _ := http.NewRequest("GET", gateway.URL+"/users", nil)
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(data) != consumer.ID {
+			t.Errorf("%s signed with %s: gateway identified %q, want %q", tt.format, tt.signingKey, data, consumer.ID)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+const (
+	roundRobin         = "round_robin"
+	weightedRoundRobin = "weighted_round_robin"
+	leastRequest       = "least_request"
+	randomTwo          = "random_two"
+	consistentHash     = "consistent_hash"
+)
+
+const (
+	hashOnHeader   = "header"
+	hashOnConsumer = "consumer"
+	hashOnIP       = "ip"
+)
+
+// balancer picks one upstream from the available upstreams of a service.
+// The caller must hold the service lock.
+type balancer interface {
+	pick(upstreams []*upstream, key string) *upstream
+}
+
+func newBalancer(name string) balancer {
+	switch name {
+	case weightedRoundRobin:
+		return &weightedRoundRobinBalancer{}
+	case leastRequest:
+		return &leastRequestBalancer{}
+	case randomTwo:
+		return &randomTwoBalancer{}
+	case consistentHash:
+		return &consistentHashBalancer{}
+	default:
+		return &roundRobinBalancer{}
+	}
+}
+
+func isValidBalancer(name string) bool {
+	switch name {
+	case "", roundRobin, weightedRoundRobin, leastRequest, randomTwo, consistentHash:
+		return true
+	}
+	return false
+}
+
+type roundRobinBalancer struct {
+}
+
+func (b *roundRobinBalancer) pick(upstreams []*upstream, key string) *upstream {
+	if len(upstreams) == 1 {
+		return upstreams[0]
+	}
+
+	for _, u := range upstreams {
+		if u.count == 0 {
+			u.count++
+			return u
+		}
+	}
+	// reset count
+	for _, u := range upstreams {
+		u.count = 0
+	}
+	upstreams[0].count++
+	return upstreams[0]
+}
+
+// weightedRoundRobinBalancer is the smooth weighted round robin which nginx uses.
+type weightedRoundRobinBalancer struct {
+}
+
+func (b *weightedRoundRobinBalancer) pick(upstreams []*upstream, key string) *upstream {
+	var result *upstream
+	total := 0
+	for _, u := range upstreams {
+		weight := u.weight()
+		u.currentWeight += weight
+		total += weight
+		if result == nil || u.currentWeight > result.currentWeight {
+			result = u
+		}
+	}
+	result.currentWeight -= total
+	return result
+}
+
+type leastRequestBalancer struct {
+}
+
+func (b *leastRequestBalancer) pick(upstreams []*upstream, key string) *upstream {
+	var result *upstream
+	for _, u := range upstreams {
+		if result == nil || u.ActiveRequests < result.ActiveRequests {
+			result = u
+		}
+	}
+	return result
+}
+
+// randomTwoBalancer picks two upstreams randomly and chooses the one with less active requests.
+type randomTwoBalancer struct {
+}
+
+func (b *randomTwoBalancer) pick(upstreams []*upstream, key string) *upstream {
+	if len(upstreams) == 1 {
+		return upstreams[0]
+	}
+	i := rand.Intn(len(upstreams))
+	j := rand.Intn(len(upstreams) - 1)
+	if j >= i {
+		j++
+	}
+	if upstreams[j].ActiveRequests < upstreams[i].ActiveRequests {
+		return upstreams[j]
+	}
+	return upstreams[i]
+}
+
+// consistentHashBalancer uses rendezvous hashing, so only the requests of a removed upstream are moved
+// to other upstreams.  The balancer falls back to random when the hash key is empty.
+type consistentHashBalancer struct {
+}
+
+func (b *consistentHashBalancer) pick(upstreams []*upstream, key string) *upstream {
+	if len(key) == 0 {
+		return upstreams[rand.Intn(len(upstreams))]
+	}
+
+	var result *upstream
+	var max uint64
+	for _, u := range upstreams {
+		h := fnv.New64a()
+		h.Write([]byte(u.Name))
+		h.Write([]byte(key))
+		score := mix64(h.Sum64())
+		if result == nil || score > max {
+			result = u
+			max = score
+		}
+	}
+	return result
+}
+
+// mix64 spreads the bits of fnv hash, so upstreams whose names only differ in the last character
+// still get an even share of keys.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hashKey returns the value which consistent hash balancer uses for sticky routing.
+func (s *service) hashKey(req *http.Request, consumer Consumer, clientIP string) string {
+	if s.LoadBalancer != consistentHash {
+		return ""
+	}
+	switch strings.ToLower(s.HashOn) {
+	case hashOnHeader:
+		return req.Header.Get(s.HashHeader)
+	case hashOnConsumer:
+		return consumer.ID
+	default:
+		return clientIP
+	}
+}
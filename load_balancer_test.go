@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestUpstreams(weights ...int) []*upstream {
+	upstreams := []*upstream{}
+	for i, weight := range weights {
+		upstreams = append(upstreams, &upstream{Name: fmt.Sprintf("u%d", i+1), Weight: weight})
+	}
+	return upstreams
+}
+
+func pickNames(b balancer, upstreams []*upstream, key string, times int) []string {
+	names := []string{}
+	for i := 0; i < times; i++ {
+		names = append(names, b.pick(upstreams, key).Name)
+	}
+	return names
+}
+
+func TestNewBalancer(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", "*main.roundRobinBalancer"},
+		{roundRobin, "*main.roundRobinBalancer"},
+		{weightedRoundRobin, "*main.weightedRoundRobinBalancer"},
+		{leastRequest, "*main.leastRequestBalancer"},
+		{randomTwo, "*main.randomTwoBalancer"},
+		{consistentHash, "*main.consistentHashBalancer"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprintf("%T", newBalancer(tt.name)); got != tt.want {
+			t.Errorf("newBalancer(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if isValidBalancer("unknown") {
+		t.Error("isValidBalancer(unknown) = true, want false")
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	tests := []struct {
+		upstreams int
+		want      string
+	}{
+		{1, "[u1 u1 u1 u1]"},
+		{2, "[u1 u2 u1 u2]"},
+		{3, "[u1 u2 u3 u1]"},
+	}
+	for _, tt := range tests {
+		upstreams := newTestUpstreams(make([]int, tt.upstreams)...)
+		got := fmt.Sprint(pickNames(&roundRobinBalancer{}, upstreams, "", 4))
+		if got != tt.want {
+			t.Errorf("%d upstreams: got %s, want %s", tt.upstreams, got, tt.want)
+		}
+	}
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    []string
+	}{
+		{[]int{1, 1}, []string{"u1", "u2", "u1", "u2"}},
+		{[]int{0, 0}, []string{"u1", "u2", "u1", "u2"}},
+		{[]int{5, 1, 1}, []string{"u1", "u1", "u2", "u1", "u3", "u1", "u1"}},
+		{[]int{3, 1}, []string{"u1", "u1", "u2", "u1"}},
+	}
+	for _, tt := range tests {
+		upstreams := newTestUpstreams(tt.weights...)
+		got := pickNames(&weightedRoundRobinBalancer{}, upstreams, "", len(tt.want))
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("weights %v: got %s, want %s", tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestLeastRequestBalancer(t *testing.T) {
+	tests := []struct {
+		active []int64
+		want   string
+	}{
+		{[]int64{3, 1, 2}, "u2"},
+		{[]int64{0, 0, 0}, "u1"},
+		{[]int64{2, 2, 1}, "u3"},
+	}
+	for _, tt := range tests {
+		upstreams := newTestUpstreams(make([]int, len(tt.active))...)
+		for i, active := range tt.active {
+			upstreams[i].ActiveRequests = active
+		}
+		if got := (&leastRequestBalancer{}).pick(upstreams, "").Name; got != tt.want {
+			t.Errorf("active %v: got %s, want %s", tt.active, got, tt.want)
+		}
+	}
+}
+
+func TestRandomTwoBalancer(t *testing.T) {
+	// the busiest upstream is never picked when it's compared with another one
+	upstreams := newTestUpstreams(0, 0, 0)
+	upstreams[2].ActiveRequests = 10
+	for _, name := range pickNames(&randomTwoBalancer{}, upstreams, "", 100) {
+		if name == "u3" {
+			t.Fatal("the busiest upstream was picked")
+		}
+	}
+
+	single := newTestUpstreams(0)
+	if got := (&randomTwoBalancer{}).pick(single, "").Name; got != "u1" {
+		t.Errorf("got %s, want u1", got)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	b := &consistentHashBalancer{}
+	upstreams := newTestUpstreams(0, 0, 0, 0)
+
+	picked := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		name := b.pick(upstreams, key).Name
+		picked[key] = name
+		counts[name]++
+	}
+	for _, u := range upstreams {
+		if counts[u.Name] < 150 {
+			t.Errorf("%s got %d of 1000 keys, the keys aren't spread evenly", u.Name, counts[u.Name])
+		}
+	}
+
+	// the same key is routed to the same upstream
+	for key, name := range picked {
+		if got := b.pick(upstreams, key).Name; got != name {
+			t.Fatalf("key %s: got %s, want %s", key, got, name)
+		}
+	}
+
+	// only the keys of the removed upstream are moved
+	remaining := upstreams[:3]
+	for key, name := range picked {
+		got := b.pick(remaining, key).Name
+		if name != "u4" && got != name {
+			t.Fatalf("key %s moved from %s to %s", key, name, got)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-User", "alice")
+	consumer := Consumer{ID: "c1"}
+
+	tests := []struct {
+		svc  *service
+		want string
+	}{
+		{&service{LoadBalancer: roundRobin}, ""},
+		{&service{LoadBalancer: consistentHash}, "10.0.0.1"},
+		{&service{LoadBalancer: consistentHash, HashOn: hashOnIP}, "10.0.0.1"},
+		{&service{LoadBalancer: consistentHash, HashOn: hashOnConsumer}, "c1"},
+		{&service{LoadBalancer: consistentHash, HashOn: hashOnHeader, HashHeader: "X-User"}, "alice"},
+	}
+	for _, tt := range tests {
+		if got := tt.svc.hashKey(req, consumer, "10.0.0.1"); got != tt.want {
+			t.Errorf("hash_on %q: got %q, want %q", tt.svc.HashOn, got, tt.want)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"flag"
 	"io/ioutil"
 	"log"
@@ -20,23 +20,27 @@ import (
 )
 
 var (
-	_app          *application
-	_httpClient   *http.Client
-	_config       Configuration
-	_logger       *logger
-	_consumerRepo ConsumerRepository
-	_tokenRepo    TokenRepository
-	_apiRepo      APIRepository
-	_corsRepo     CORSRepository
-	_serviceRepo  ServiceRepository
-	_status       *status
-	_apis         []*api
-	_cors         *configCORS
-	_services     []*service
-	_messageChan  chan *gelfMessage
+	_app           *application
+	_httpClient    *http.Client
+	_config        Configuration
+	_logger        *logger
+	_consumerRepo  ConsumerRepository
+	_tokenRepo     TokenRepository
+	_apiKeyRepo    APIKeyRepository
+	_apiRepo       APIRepository
+	_corsRepo      CORSRepository
+	_serviceRepo   ServiceRepository
+	_rateLimitRepo RateLimitRepository
+	_cacheRepo     CacheRepository
+	_jwtKeys       *jwtKeySet
+	_status        *status
+	_cors          *configCORS
+	_messageChan   chan *gelfMessage
 )
 
-func init() {
+// initialize reads the config file and sets up the storages.  It isn't an init function because init runs before
+// every test as well, the test binary has no config.yml next to it and flag.Parse in init rejects the flags of go test.
+func initialize() {
 	flag.Parse()
 
 	//read and parse config file
@@ -71,6 +75,13 @@ func init() {
 		log.Fatal(err)
 	}
 
+	if _config.JWT.Enable {
+		_jwtKeys, err = loadJWTKeys(_config.JWT)
+		if err != nil {
+			log.Fatalf("jwt error: %v", err)
+		}
+	}
+
 	// setup logger
 	_logger = newLog()
 	if _config.Debug {
@@ -82,6 +93,7 @@ func init() {
 	if _config.Data.Type == "memory" {
 		_consumerRepo = newConsumerMemStore()
 		_tokenRepo = newTokenMemStore()
+		_apiKeyRepo = newAPIKeyMemStore()
 	}
 	if _config.Data.Type == "mongodb" {
 		_consumerRepo, err = newConsumerMongo(_config.Data.ConnectionString)
@@ -92,6 +104,10 @@ func init() {
 		if err != nil {
 			panic(err)
 		}
+		_apiKeyRepo, err = newAPIKeyMongo(_config.Data.ConnectionString)
+		if err != nil {
+			panic(err)
+		}
 		_apiRepo, err = newAPIMongo(_config.Data.ConnectionString)
 		if err != nil {
 			panic(err)
@@ -123,23 +139,53 @@ func init() {
 		if err != nil {
 			panic(err)
 		}
+		_apiKeyRepo, err = newAPIKeyRedis(_config.Data.Address, _config.Data.Password, db)
+		if err != nil {
+			panic(err)
+		}
 		_corsRepo, err = newCorsRedis(_config.Data.Address, _config.Data.Password, db)
 		if err != nil {
 			panic(err)
 		}
 	}
 
+	// initial rate limit counters
+	if _config.RateLimit.Store == "redis" {
+		db, _ := strconv.Atoi(_config.Data.DB)
+		_rateLimitRepo, err = newRateLimitRedis(_config.Data.Address, _config.Data.Password, db)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		_rateLimitRepo = newRateLimitMemStore()
+	}
+
+	// initial response cache
+	if _config.Cache.Store == "redis" {
+		db, _ := strconv.Atoi(_config.Data.DB)
+		_cacheRepo, err = newCacheRedis(_config.Data.Address, _config.Data.Password, db)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		_cacheRepo = newCacheMemStore(_config.Cache.MaxEntries)
+	}
+
 	_app = newApplication()
 	_logger.infof("hostname: %v", _app.hostname)
 
 	// load api
-	_apis, err = _apiRepo.GetAll()
+	services, err := _serviceRepo.GetAll()
 	panicIf(err)
-	_services, err = _serviceRepo.GetAll()
+	setServices(services)
+	apis, err := _apiRepo.GetAll()
 	panicIf(err)
+	setAPIs(apis)
 }
 
 func main() {
+	initialize()
+
 	nap := napnap.New()
 	nap.ForwardRemoteIpAddress = true
 	nap.UseFunc(requestIDMiddleware())
@@ -175,7 +221,7 @@ func main() {
 	gzip := _config.Gzip
 	if gzip.Enable {
 		_logger.info("gzip was enabled")
-		nap.Use(napnap.NewGzip(napnap.DefaultCompression))
+		nap.UseFunc(newGzipMiddleware(napnap.DefaultCompression))
 	}
 
 	// turn on health check feature
@@ -198,7 +244,23 @@ func main() {
 		_logger.infof("cors was enabled: %v", strings.Join(_cors.AllowedOrigins[:], ","))
 	}
 
+	// check upstreams of services in the background
+	go runHealthChecks()
+
+	// deny the client ips before identity
+	nap.UseFunc(ipRestrictionMiddleware)
+
+	// reject the requests which exceed the limits
+	nap.UseFunc(requestLimitMiddleware)
+
+	// turn on oauth2 token endpoint
+	if _config.OAuth.Enable {
+		nap.UseFunc(oauthMiddleware)
+	}
+
 	nap.UseFunc(identity)
+	nap.UseFunc(authorization)
+	nap.Use(newRateLimitMiddleware())
 	nap.Use(newProxy())
 	nap.UseFunc(notFound)
 
@@ -207,6 +269,7 @@ func main() {
 	adminNap.Use(napnap.NewHealth())
 	adminNap.Use(newApplicationLogMiddleware(false))
 	adminNap.UseFunc(requestIDMiddleware())
+	adminNap.UseFunc(jwksMiddleware)
 	adminNap.UseFunc(auth) // verify all request which send to admin api and ensure the caller has valid admin token.
 
 	adminRouter := napnap.NewRouter()
@@ -217,6 +280,9 @@ func main() {
 	adminRouter.Get("/v1/consumers/:consumer_id", getConsumerEndpoint)
 	adminRouter.Delete("/v1/consumers/:consumer_id", deletedConsumerEndpoint)
 	adminRouter.Put("/v1/consumers", createOrupateConsumerEndpoint)
+	adminRouter.Get("/v1/consumers/:consumer_id/keys", listAPIKeysEndpoint)
+	adminRouter.Post("/v1/consumers/:consumer_id/keys", createAPIKeyEndpoint)
+	adminRouter.Delete("/v1/consumers/:consumer_id/keys/:key_id", deleteAPIKeyEndpoint)
 
 	// token endpoints
 	//adminRouter.Put("/v1/tokens/:key/expire", expireTokenEndpoint) //deprecated
@@ -233,6 +299,8 @@ func main() {
 	adminRouter.Get("/v1/apis/:api_id", getAPIEndpoint)
 	adminRouter.Delete("/v1/apis/:api_id", deleteAPIEndpoint)
 	adminRouter.Put("/v1/apis/:api_id", updateAPIEndpoint)
+	adminRouter.Put("/v1/apis/:api_id/traffic_split", updateTrafficSplitEndpoint)
+	adminRouter.Delete("/v1/apis/:api_id/traffic_split", deleteTrafficSplitEndpoint)
 	adminRouter.Get("/v1/apis", listAPIEndpoint)
 	adminRouter.Post("/v1/apis", createAPIEndpoint)
 
@@ -248,6 +316,9 @@ func main() {
 	adminRouter.Post("/v1/services", createServicesEndpoint)
 	adminRouter.Get("/v1/services", listServicesEndpoint)
 
+	// cache endpoints
+	adminRouter.Delete("/v1/cache", purgeCacheEndpoint)
+
 	// config endpoints
 	adminRouter.Put("/v1/configs/cors/reload", reloadCORSEndpoint)
 	adminRouter.Get("/v1/configs/cors", getCORSEndpoint)
@@ -271,7 +342,7 @@ func main() {
 	}()
 	go func() {
 		// http server for bifrost service
-		err := nap.RunAll(_config.Binds)
+		err := runAll(_config.Binds, withRawWriter(withOriginalBody(nap)))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -285,10 +356,22 @@ func main() {
 				Cache:      autocert.DirCache("./certs"),
 			}
 
+			// HTTP/2 is required by gRPC clients, the protocols are added to the ones of autocert which
+			// answers the tls-alpn challenges of ACME as well
+			tlsConfig := m.TLSConfig()
+			for _, proto := range []string{"h2", "http/1.1"} {
+				if !contains(tlsConfig.NextProtos, proto) {
+					tlsConfig.NextProtos = append(tlsConfig.NextProtos, proto)
+				}
+			}
+			protocols := new(http.Protocols)
+			protocols.SetHTTP1(true)
+			protocols.SetHTTP2(true)
 			s := &http.Server{
 				Addr:      _config.TLS.Addr,
-				TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
-				Handler:   nap,
+				TLSConfig: tlsConfig,
+				Protocols: protocols,
+				Handler:   withRawWriter(withOriginalBody(nap)),
 			}
 			err := s.ListenAndServeTLS("", "")
 			if err != nil {
@@ -300,3 +383,17 @@ func main() {
 
 	wg.Wait()
 }
+
+// runAll listens on multiple addresses like napnap's RunAll, but it serves the handler which wraps napnap.
+func runAll(addrs []string, handler http.Handler) error {
+	if len(addrs) == 0 {
+		return errors.New("binds can't be empty")
+	}
+	errc := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			errc <- http.ListenAndServe(addr, handler)
+		}(addr)
+	}
+	return <-errc
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// setupTestRoutes replaces the route table with the services and the api entries, the table is
+// emptied again when the test finishes.
+func setupTestRoutes(t *testing.T, services []*service, apis []*api) {
+	if _logger == nil {
+		_logger = newLog()
+	}
+	_routes.Store(newRouteTable(nil, nil))
+	t.Cleanup(func() {
+		_routes.Store(newRouteTable(nil, nil))
+	})
+	for _, svc := range services {
+		if err := svc.isValid(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setServices(services)
+	setAPIs(apis)
+}
+
+// newTestGateway serves the middlewares the way main does, identity is replaced by the consumer.
+func newTestGateway(t *testing.T, consumer Consumer, middlewares ...napnap.MiddlewareFunc) *httptest.Server {
+	nap := napnap.New()
+	nap.UseFunc(requestIDMiddleware())
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.Set("consumer", consumer)
+		next(c)
+	})
+	for _, middleware := range middlewares {
+		nap.UseFunc(middleware)
+	}
+	nap.UseFunc(notFound)
+
+	server := httptest.NewServer(withRawWriter(withOriginalBody(nap)))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestAdmin serves the endpoints of the router the way the admin port does, without admin tokens.
+func newTestAdmin(t *testing.T, router *napnap.Router) *httptest.Server {
+	nap := napnap.New()
+	nap.Use(newApplicationLogMiddleware(false))
+	nap.UseFunc(requestIDMiddleware())
+	nap.Use(router)
+	nap.UseFunc(notFound)
+
+	server := httptest.NewServer(nap)
+	t.Cleanup(server.Close)
+	return server
+}
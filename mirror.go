@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+const (
+	defaultMirrorTimeout = 5000 // milliseconds
+	maxMirrorBodySize    = 1024 * 1024
+)
+
+// mirror sends a copy of the requests to another service or url in the background, the mirrored
+// responses are discarded and only their status and latency are logged.
+type mirror struct {
+	Service   string `json:"service,omitempty" bson:"service,omitempty"`
+	TargetURL string `json:"target_url,omitempty" bson:"target_url,omitempty"`
+	// Percentage is the sampled percentage of requests, all requests are mirrored by default.
+	Percentage int `json:"percentage" bson:"percentage"`
+	Timeout    int `json:"timeout" bson:"timeout"` // milliseconds
+	// CopyIdentity sends the credentials and the consumer headers to the mirror as well, they are removed
+	// by default because the mirror is often a service which isn't trusted like the upstreams.
+	CopyIdentity bool `json:"copy_identity" bson:"copy_identity"`
+}
+
+func (m *mirror) isValid() error {
+	if len(m.Service) == 0 && len(m.TargetURL) == 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "mirror requires service or target_url"}
+	}
+	if m.Percentage < 0 || m.Percentage > 100 {
+		return AppError{ErrorCode: "invalid_input", Message: "percentage of mirror must be between 0 and 100"}
+	}
+	if m.Percentage == 0 {
+		m.Percentage = 100
+	}
+	if m.Timeout < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "timeout of mirror can't be negative"}
+	}
+	if m.Timeout == 0 {
+		m.Timeout = defaultMirrorTimeout
+	}
+	return nil
+}
+
+func (m *mirror) isSampled() bool {
+	return m.Percentage >= 100 || rand.Intn(100) < m.Percentage
+}
+
+// mirrorResult is the status and latency of the request which was sent to upstream.
+type mirrorResult struct {
+	status   int
+	duration time.Duration
+	err      error
+}
+
+// startMirror sends the copy of the request in the background.  The result of the original request must be
+// sent to the returned channel, so the difference can be logged.  nil is returned when the request isn't mirrored.
+func (p *proxy) startMirror(c *napnap.Context, route *routeMatch, consumer Consumer, timeouts TimeoutSetting) chan<- mirrorResult {
+	m := route.api.Mirror
+	if route.api.Redirect || isUpgradeRequest(c.Request) || isGRPCRequest(c.Request) || !m.isSampled() {
+		return nil
+	}
+
+	// the body is kept in memory for the copy, large bodies are not mirrored
+	var body []byte
+	if c.Request.ContentLength != 0 && c.Request.Body != nil {
+		buf, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxMirrorBodySize+1))
+		c.Request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buf), c.Request.Body))
+		if err != nil || len(buf) > maxMirrorBodySize {
+			_logger.debug("request body is too large to mirror")
+			return nil
+		}
+		body = buf
+	}
+
+	targetURL := m.TargetURL
+	var svcEntry *service
+	var upstreamEntry *upstream
+	if len(m.Service) > 0 {
+		svcEntry = currentRoutes().service(m.Service)
+		if svcEntry != nil {
+			upstreamEntry = svcEntry.askForUpstream("", nil)
+			if upstreamEntry != nil {
+				targetURL = upstreamEntry.TargetURL
+			}
+		}
+	}
+	if len(targetURL) == 0 {
+		_logger.debugf("mirror upstream is unavailable: %s", route.api.Name)
+		return nil
+	}
+
+	// the request is built here, because the context is reused after the request
+	url := p.buildURL(route, targetURL, c.Request)
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	outReq := p.newOutRequest(c, consumer, url, bodyReader)
+	if !m.CopyIdentity {
+		removeIdentityHeaders(outReq.Header)
+	}
+	if route.api.Rewrite != nil && len(route.api.Rewrite.Host) > 0 {
+		outReq.Host = route.api.Rewrite.Host
+	}
+	if route.api.Headers != nil {
+		route.api.Headers.Request.apply(outReq.Header, newTemplateVars(c, consumer, route))
+	}
+	requestID := c.MustGet("request-id").(string)
+	client := p.clientFor(timeouts, upstreamProtocol(route.api, svcEntry, c.Request))
+
+	primary := make(chan mirrorResult, 1)
+	go func() {
+		if upstreamEntry != nil {
+			defer svcEntry.releaseUpstream(upstreamEntry)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Timeout)*time.Millisecond)
+		defer cancel()
+
+		startTime := time.Now()
+		result := mirrorResult{}
+		resp, err := client.Do(outReq.WithContext(ctx))
+		if err == nil {
+			// the mirrored response is discarded
+			err = respClose(resp.Body)
+			result.status = resp.StatusCode
+		}
+		result.err = err
+		result.duration = time.Since(startTime)
+
+		select {
+		case original := <-primary:
+			logMirror(requestID, outReq, original, result)
+		case <-time.After(time.Duration(m.Timeout) * time.Millisecond):
+			logMirror(requestID, outReq, mirrorResult{}, result)
+		}
+	}()
+	return primary
+}
+
+// removeIdentityHeaders removes the credentials of the client and the consumer headers of bifrost.
+func removeIdentityHeaders(header http.Header) {
+	header.Del("Authorization")
+	header.Del("X-Token")
+	for name := range header {
+		if strings.HasPrefix(name, "X-Consumer") {
+			header.Del(name)
+		}
+	}
+}
+
+// logMirror writes the access log of the mirrored request with the difference from the original one.
+func logMirror(requestID string, outReq *http.Request, original mirrorResult, result mirrorResult) {
+	duration := int64(result.duration / time.Millisecond)
+	accessLog := newGelfMessage(_app.hostname, _app.name, "access", 6)
+	accessLog.ShortMessage = fmt.Sprintf("mirror %s %s [%d] %dms", outReq.Method, outReq.URL.Path, result.status, duration)
+	accessLog.CustomFields["request_id"] = requestID
+	accessLog.CustomFields["mirror"] = true
+	accessLog.CustomFields["mirror_url"] = outReq.URL.String()
+	accessLog.CustomFields["mirror_status"] = result.status
+	accessLog.CustomFields["mirror_duration"] = duration
+	if result.err != nil {
+		accessLog.CustomFields["mirror_error"] = result.err.Error()
+	}
+	if original.status > 0 {
+		originalDuration := int64(original.duration / time.Millisecond)
+		accessLog.CustomFields["status"] = original.status
+		accessLog.CustomFields["duration"] = originalDuration
+		accessLog.CustomFields["mirror_status_diff"] = original.status != result.status
+		accessLog.CustomFields["mirror_duration_diff"] = duration - originalDuration
+	}
+
+	select {
+	case _messageChan <- accessLog:
+	default:
+		_logger.debug("message queue was full")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorRequest(t *testing.T) {
+	if _app == nil {
+		_app = newApplication()
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consumer", r.Header.Get("X-Consumer-Id"))
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer primary.Close()
+	type mirroredRequest struct {
+		method string
+		uri    string
+		header http.Header
+		body   string
+	}
+	mirrored := make(chan mirroredRequest, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.Method, r.URL.RequestURI(), r.Header.Clone(), string(body)}
+		w.WriteHeader(500)
+	}))
+	defer shadow.Close()
+
+	tests := []struct {
+		name         string
+		copyIdentity bool
+		wantConsumer string
+	}{
+		{"identity is removed", false, ""},
+		{"identity is copied", true, "c1"},
+	}
+	for _, tt := range tests {
+		_config = newConfiguration()
+		setupTestRoutes(t, []*service{
+			{ID: "s1", Name: "users", Upstreams: []*upstream{{Name: "u1", TargetURL: primary.URL}}},
+			{ID: "s2", Name: "shadow", Upstreams: []*upstream{{Name: "u2", TargetURL: shadow.URL}}},
+		}, []*api{
+			{Name: "users", RequestHost: "*", RequestPath: "/users", Service: "users",
+				Mirror: &mirror{Service: "shadow", Percentage: 100, Timeout: 1000, CopyIdentity: tt.copyIdentity}},
+		})
+		gateway := newTestGateway(t, Consumer{ID: "c1", App: "web", Username: "alice"}, newProxy().Invoke)
+
+		req, _ := http.NewRequest("POST", gateway.URL+"/users/1?q=1", strings.NewReader(`{"name": "alice"}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("X-Consumer-Id", "forged")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// the response of mirror is discarded
+		if resp.StatusCode != 200 || string(body) != `{"name": "alice"}` || resp.Header.Get("X-Consumer") != "c1" {
+			t.Errorf("%s: got %d %s from %s, want the response of primary", tt.name, resp.StatusCode, body, resp.Header.Get("X-Consumer"))
+		}
+
+		select {
+		case r := <-mirrored:
+			if r.method != "POST" || r.uri != "/users/1?q=1" || r.body != `{"name": "alice"}` {
+				t.Errorf("%s: mirror got %s %s %s", tt.name, r.method, r.uri, r.body)
+			}
+			if got := r.header.Get("X-Consumer-Id"); got != tt.wantConsumer {
+				t.Errorf("%s: X-Consumer-Id of mirror = %q, want %q", tt.name, got, tt.wantConsumer)
+			}
+			if got := len(r.header.Get("Authorization")) > 0; got != tt.copyIdentity {
+				t.Errorf("%s: mirror got Authorization %v, want %v", tt.name, got, tt.copyIdentity)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: the request wasn't mirrored", tt.name)
+		}
+	}
+}
+
+func TestAPICheckServicesOfMirror(t *testing.T) {
+	setupTestRoutes(t, []*service{{ID: "s1", Name: "shadow"}}, nil)
+	tests := []struct {
+		mirror  *mirror
+		wantErr bool
+	}{
+		{nil, false},
+		{&mirror{Service: "shadow"}, false},
+		{&mirror{TargetURL: "http://10.0.0.1"}, false},
+		{&mirror{Service: "other"}, true},
+	}
+	for _, tt := range tests {
+		apiEntry := &api{Name: "users", Mirror: tt.mirror}
+		if err := apiEntry.checkServices(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, wantErr %v", tt.mirror, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	oauthTokenPath = "/oauth/token"
+
+	grantClientCredentials = "client_credentials"
+	grantRefreshToken      = "refresh_token"
+)
+
+// oauthError is the error response of RFC 6749 section 5.2.
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// oauthMiddleware serves the oauth2 token endpoint on the gateway, the issued access tokens are stored in
+// token repository, so identity accepts them like the tokens which are created by admin api.
+func oauthMiddleware(c *napnap.Context, next napnap.HandlerFunc) {
+	if c.Request.URL.Path != oauthTokenPath {
+		next(c)
+		return
+	}
+	if c.Request.Method != "POST" {
+		c.SetStatus(405)
+		return
+	}
+
+	c.RespHeader("Cache-Control", "no-store")
+	c.RespHeader("Pragma", "no-cache")
+
+	// client credentials are sent by basic authentication or form
+	clientID, clientSecret, ok := c.Request.BasicAuth()
+	if !ok {
+		clientID = c.Form("client_id")
+		clientSecret = c.Form("client_secret")
+	}
+	if len(clientID) == 0 || len(clientSecret) == 0 {
+		c.JSON(401, oauthError{Error: "invalid_client", ErrorDescription: "client credentials were missing"})
+		return
+	}
+	consumer, err := _consumerRepo.GetByClientID(clientID)
+	panicIf(err)
+	if consumer == nil {
+		// the secret is verified anyway, so the response time doesn't tell whether the client exists
+		verifyPassword(dummyPasswordHash, clientSecret)
+	}
+	if consumer == nil || !verifyPassword(consumer.ClientSecretHash, clientSecret) {
+		c.JSON(401, oauthError{Error: "invalid_client", ErrorDescription: "client authentication failed"})
+		return
+	}
+
+	switch c.Form("grant_type") {
+	case grantClientCredentials:
+		scopes, ok := grantScopes(c.Form("scope"), consumer.AllowedScopes)
+		if !ok {
+			c.JSON(400, oauthError{Error: "invalid_scope"})
+			return
+		}
+		issueOAuthToken(c, consumer, scopes)
+	case grantRefreshToken:
+		refreshToken, err := _tokenRepo.Get(c.Form("refresh_token"))
+		panicIf(err)
+		if refreshToken == nil || refreshToken.Type != tokenTypeRefresh || refreshToken.ConsumerID != consumer.ID || !refreshToken.isValid() {
+			c.JSON(400, oauthError{Error: "invalid_grant", ErrorDescription: "refresh token is invalid or expired"})
+			return
+		}
+		// the scopes can't exceed the original grant
+		allowed := []string{}
+		for _, scope := range refreshToken.Scopes {
+			if contains(consumer.AllowedScopes, scope) {
+				allowed = append(allowed, scope)
+			}
+		}
+		scopes, ok := grantScopes(c.Form("scope"), allowed)
+		if !ok {
+			c.JSON(400, oauthError{Error: "invalid_scope"})
+			return
+		}
+		// refresh token is rotated
+		err = _tokenRepo.Delete(refreshToken.ID)
+		panicIf(err)
+		issueOAuthToken(c, consumer, scopes)
+	case "":
+		c.JSON(400, oauthError{Error: "invalid_request", ErrorDescription: "grant_type was missing"})
+	default:
+		c.JSON(400, oauthError{Error: "unsupported_grant_type"})
+	}
+}
+
+// grantScopes returns the requested scopes, all allowed scopes are granted when nothing was requested.
+func grantScopes(requested string, allowed []string) ([]string, bool) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return allowed, true
+	}
+	for _, scope := range scopes {
+		if !contains(allowed, scope) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+func issueOAuthToken(c *napnap.Context, consumer *Consumer, scopes []string) {
+	setting := _config.OAuth
+	now := time.Now().UTC()
+
+	accessToken := &Token{
+		ID:         uuid.NewV4().String(),
+		Source:     "oauth",
+		ConsumerID: consumer.ID,
+		Scopes:     scopes,
+		Expiration: now.Add(time.Duration(setting.AccessTokenTimeout) * time.Second),
+	}
+	err := _tokenRepo.Insert(accessToken)
+	panicIf(err)
+
+	refreshToken := &Token{
+		ID:         uuid.NewV4().String(),
+		Source:     "oauth",
+		Type:       tokenTypeRefresh,
+		ConsumerID: consumer.ID,
+		Scopes:     scopes,
+		Expiration: now.Add(time.Duration(setting.RefreshTokenTimeout) * time.Second),
+	}
+	err = _tokenRepo.Insert(refreshToken)
+	panicIf(err)
+
+	c.JSON(200, oauthTokenResponse{
+		AccessToken:  accessToken.ID,
+		TokenType:    "bearer",
+		ExpiresIn:    setting.AccessTokenTimeout,
+		RefreshToken: refreshToken.ID,
+		Scope:        strings.Join(scopes, " "),
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGrantScopes(t *testing.T) {
+	allowed := []string{"read", "write"}
+	tests := []struct {
+		requested string
+		allowed   []string
+		want      []string
+		ok        bool
+	}{
+		{"", allowed, allowed, true},
+		{"  ", allowed, allowed, true},
+		{"read", allowed, []string{"read"}, true},
+		{"write  read", allowed, []string{"write", "read"}, true},
+		{"read admin", allowed, nil, false},
+		{"admin", allowed, nil, false},
+		{"read", nil, nil, false},
+		{"", nil, nil, true},
+		{"READ", allowed, nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := grantScopes(tt.requested, tt.allowed)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("grantScopes(%q, %v) = (%v, %v), want (%v, %v)", tt.requested, tt.allowed, got, ok, tt.want, tt.ok)
+		}
+	}
+}
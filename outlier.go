@@ -0,0 +1,215 @@
+package main
+
+import "time"
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// outlierDetection ejects an upstream for a while when it keeps failing.
+type outlierDetection struct {
+	ConsecutiveErrors int `json:"consecutive_errors" bson:"consecutive_errors"`
+	ErrorRate         int `json:"error_rate" bson:"error_rate"` // percentage
+	MinRequests       int `json:"min_requests" bson:"min_requests"`
+	Interval          int `json:"interval" bson:"interval"`                     // seconds
+	BaseEjectionTime  int `json:"base_ejection_time" bson:"base_ejection_time"` // seconds
+	MaxEjectionTime   int `json:"max_ejection_time" bson:"max_ejection_time"`   // seconds
+}
+
+func (od *outlierDetection) isValid() error {
+	if od.ConsecutiveErrors < 0 || od.ErrorRate < 0 || od.ErrorRate > 100 {
+		return AppError{ErrorCode: "invalid_input", Message: "outlier_detection thresholds are invalid"}
+	}
+	if od.ConsecutiveErrors == 0 && od.ErrorRate == 0 {
+		od.ConsecutiveErrors = 5
+	}
+	if od.MinRequests <= 0 {
+		od.MinRequests = 10
+	}
+	if od.Interval <= 0 {
+		od.Interval = 10
+	}
+	if od.BaseEjectionTime <= 0 {
+		od.BaseEjectionTime = 30
+	}
+	if od.MaxEjectionTime < od.BaseEjectionTime {
+		od.MaxEjectionTime = 10 * od.BaseEjectionTime
+	}
+	return nil
+}
+
+// circuitBreaker stops sending requests to the service when the service keeps failing.
+type circuitBreaker struct {
+	ConsecutiveErrors int `json:"consecutive_errors" bson:"consecutive_errors"`
+	OpenTimeout       int `json:"open_timeout" bson:"open_timeout"` // seconds
+	HalfOpenRequests  int `json:"half_open_requests" bson:"half_open_requests"`
+}
+
+func (cb *circuitBreaker) isValid() error {
+	if cb.ConsecutiveErrors < 0 || cb.OpenTimeout < 0 || cb.HalfOpenRequests < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "circuit_breaker fields can't be negative"}
+	}
+	if cb.ConsecutiveErrors == 0 {
+		cb.ConsecutiveErrors = 20
+	}
+	if cb.OpenTimeout == 0 {
+		cb.OpenTimeout = 30
+	}
+	if cb.HalfOpenRequests == 0 {
+		cb.HalfOpenRequests = 3
+	}
+	return nil
+}
+
+type circuitState struct {
+	State     string     `json:"state"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	failures  int
+	probes    int
+	successes int
+}
+
+// allowRequest reports whether the circuit breaker lets the request go to the service.
+func (s *service) allowRequest() bool {
+	if s.CircuitBreaker == nil {
+		return true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.Circuit == nil {
+		s.Circuit = &circuitState{State: circuitClosed}
+	}
+	openTimeout := time.Duration(s.CircuitBreaker.OpenTimeout) * time.Second
+
+	switch s.Circuit.State {
+	case circuitOpen:
+		if time.Since(*s.Circuit.OpenedAt) < openTimeout {
+			return false
+		}
+		s.Circuit.State = circuitHalfOpen
+		s.Circuit.probes = 0
+		s.Circuit.successes = 0
+		now := time.Now().UTC()
+		s.Circuit.OpenedAt = &now
+		_logger.infof("circuit was half open: %s", s.Name)
+		fallthrough
+	case circuitHalfOpen:
+		if s.Circuit.probes >= s.CircuitBreaker.HalfOpenRequests {
+			// the probes never reported back, e.g. no upstream was available, so we start a new round
+			if time.Since(*s.Circuit.OpenedAt) < openTimeout {
+				return false
+			}
+			now := time.Now().UTC()
+			s.Circuit.OpenedAt = &now
+			s.Circuit.probes = 0
+		}
+		s.Circuit.probes++
+	}
+	return true
+}
+
+// reportResult records the result of a request which was sent to the upstream.
+func (s *service) reportResult(u *upstream, success bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now().UTC()
+	if s.OutlierDetection != nil {
+		s.detectOutlier(u, success, now)
+	}
+	if s.CircuitBreaker != nil && s.Circuit != nil {
+		s.updateCircuit(success, now)
+	}
+}
+
+func (s *service) detectOutlier(u *upstream, success bool, now time.Time) {
+	od := s.OutlierDetection
+
+	if now.Sub(u.windowStart) > time.Duration(od.Interval)*time.Second {
+		// the upstream was healthy during the last window, so we forgive its previous ejections
+		if u.windowRequests > 0 && u.windowErrors == 0 {
+			u.Ejections = 0
+		}
+		u.windowStart = now
+		u.windowRequests = 0
+		u.windowErrors = 0
+	}
+
+	u.windowRequests++
+	if success {
+		u.consecutiveErrors = 0
+		return
+	}
+	u.windowErrors++
+	u.consecutiveErrors++
+
+	eject := od.ConsecutiveErrors > 0 && u.consecutiveErrors >= od.ConsecutiveErrors
+	if od.ErrorRate > 0 && u.windowRequests >= od.MinRequests && u.windowErrors*100/u.windowRequests >= od.ErrorRate {
+		eject = true
+	}
+	if !eject || !u.isAvailable() {
+		return
+	}
+
+	// never eject the last available upstream
+	available := 0
+	for _, other := range s.Upstreams {
+		if other.isAvailable() {
+			available++
+		}
+	}
+	if available <= 1 {
+		return
+	}
+
+	u.Ejections++
+	ejectionTime := time.Duration(od.BaseEjectionTime*u.Ejections) * time.Second
+	if max := time.Duration(od.MaxEjectionTime) * time.Second; ejectionTime > max {
+		ejectionTime = max
+	}
+	ejectedUntil := now.Add(ejectionTime)
+	u.EjectedUntil = &ejectedUntil
+	u.consecutiveErrors = 0
+	u.windowStart = now
+	u.windowRequests = 0
+	u.windowErrors = 0
+	_logger.infof("upstream was ejected: %s", s.Name+"/"+u.Name)
+}
+
+func (s *service) updateCircuit(success bool, now time.Time) {
+	cb := s.CircuitBreaker
+
+	switch s.Circuit.State {
+	case circuitHalfOpen:
+		if !success {
+			s.Circuit.State = circuitOpen
+			s.Circuit.OpenedAt = &now
+			_logger.infof("circuit was open: %s", s.Name)
+			return
+		}
+		s.Circuit.successes++
+		if s.Circuit.successes >= cb.HalfOpenRequests {
+			s.Circuit.State = circuitClosed
+			s.Circuit.OpenedAt = nil
+			s.Circuit.failures = 0
+			_logger.infof("circuit was closed: %s", s.Name)
+		}
+	case circuitOpen:
+		// requests which were sent before the circuit opened
+	default:
+		if success {
+			s.Circuit.failures = 0
+			return
+		}
+		s.Circuit.failures++
+		if s.Circuit.failures >= cb.ConsecutiveErrors {
+			s.Circuit.State = circuitOpen
+			s.Circuit.OpenedAt = &now
+			_logger.infof("circuit was open: %s", s.Name)
+		}
+	}
+}
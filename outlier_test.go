@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newStatusServer(t *testing.T, name string, status int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getBody(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestOutlierDetectionEjectsUpstream(t *testing.T) {
+	good := newStatusServer(t, "good", 200)
+	bad := newStatusServer(t, "bad", 500)
+
+	_config = newConfiguration()
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "users", OutlierDetection: &outlierDetection{ConsecutiveErrors: 2},
+			Upstreams: []*upstream{{Name: "good", TargetURL: good.URL}, {Name: "bad", TargetURL: bad.URL}}},
+	}, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/", Service: "users"},
+	})
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+
+	errors := 0
+	for i := 0; i < 20; i++ {
+		if status, _ := getBody(t, gateway.URL+"/users"); status != 200 {
+			errors++
+		}
+	}
+	if errors != 2 {
+		t.Errorf("got %d errors, want 2 before the upstream is ejected", errors)
+	}
+	svc := currentRoutes().service("users").snapshot()
+	if u := svc.Upstreams[1]; u.EjectedUntil == nil || u.Ejections != 1 {
+		t.Errorf("bad upstream: ejected until %v with %d ejections, want one ejection", u.EjectedUntil, u.Ejections)
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	_config = newConfiguration()
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "users", CircuitBreaker: &circuitBreaker{ConsecutiveErrors: 3},
+			Upstreams: []*upstream{{Name: "u1", TargetURL: server.URL}}},
+	}, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/", Service: "users"},
+	})
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+
+	for _, want := range []int{500, 500, 500, 503, 503} {
+		if status, _ := getBody(t, gateway.URL+"/users"); status != want {
+			t.Errorf("got %d, want %d", status, want)
+		}
+	}
+	if hits != 3 {
+		t.Errorf("upstream got %d requests, want 3", hits)
+	}
+	if circuit := currentRoutes().service("users").snapshot().Circuit; circuit == nil || circuit.State != circuitOpen {
+		t.Errorf("circuit = %+v, want open", circuit)
+	}
+}
+
+func TestProxyClientGoneIsNotReported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("X-Slow")) > 0 {
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	_config = newConfiguration()
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "users", CircuitBreaker: &circuitBreaker{ConsecutiveErrors: 1},
+			Upstreams: []*upstream{{Name: "u1", TargetURL: server.URL}}},
+	}, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/", Service: "users"},
+	})
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", gateway.URL+"/users", nil)
+	req.Header.Set("X-Slow", "1")
+	if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		resp.Body.Close()
+		t.Fatal("the request must be canceled")
+	}
+
+	// the upstream is released when the gateway notices the client has gone away
+	svc := currentRoutes().service("users")
+	for i := 0; i < 100 && svc.snapshot().Upstreams[0].ActiveRequests > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if active := svc.snapshot().Upstreams[0].ActiveRequests; active != 0 {
+		t.Fatalf("upstream has %d active requests, want 0", active)
+	}
+	if status, body := getBody(t, gateway.URL+"/users"); status != 200 || body != "ok" {
+		t.Errorf("got %d %q, want 200 ok because the circuit stays closed", status, body)
+	}
+}
+
+func TestProxyReleasesTriedUpstream(t *testing.T) {
+	bad := newStatusServer(t, "bad", 503)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "slow ")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "done")
+	}))
+	defer slow.Close()
+
+	_config = newConfiguration()
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "users", Upstreams: []*upstream{{Name: "bad", TargetURL: bad.URL}, {Name: "slow", TargetURL: slow.URL}}},
+	}, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/", Service: "users", Retry: &retryPolicy{MaxAttempts: 2, RetryOn: []string{retryOn5xx}}},
+	})
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+
+	resp, err := http.Get(gateway.URL + "/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the round robin picks bad first, it was released before slow was tried
+	upstreams := currentRoutes().service("users").snapshot().Upstreams
+	if upstreams[0].TotalRequests != 1 || upstreams[0].ActiveRequests != 0 || upstreams[1].ActiveRequests != 1 {
+		t.Errorf("bad has %d/%d and slow has %d active requests, want 1/0 and 1", upstreams[0].ActiveRequests,
+			upstreams[0].TotalRequests, upstreams[1].ActiveRequests)
+	}
+	close(release)
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "slow done" {
+		t.Errorf("got %q, want slow done", body)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+
+	policyModeEnforce = "enforce"
+	policyModeAudit   = "audit"
+)
+
+// policy is an allow or deny rule of api entry.  A rule matches when every condition which is set matches,
+// a condition with several values matches any of them.  Client ips are matched against the peer address
+// unless trusted_proxies is set.
+type policy struct {
+	Effect       string            `json:"effect" bson:"effect"`
+	Roles        []string          `json:"roles,omitempty" bson:"roles,omitempty"`
+	Scopes       []string          `json:"scopes,omitempty" bson:"scopes,omitempty"`
+	Apps         []string          `json:"apps,omitempty" bson:"apps,omitempty"`
+	Consumers    []string          `json:"consumers,omitempty" bson:"consumers,omitempty"`
+	CustomFields map[string]string `json:"custom_fields,omitempty" bson:"custom_fields,omitempty"`
+	Methods      []string          `json:"methods,omitempty" bson:"methods,omitempty"`
+	ClientIPs    []string          `json:"client_ips,omitempty" bson:"client_ips,omitempty"`
+	ipNets       []*net.IPNet
+}
+
+func (p *policy) isValid() error {
+	p.Effect = strings.ToLower(p.Effect)
+	if p.Effect != policyAllow && p.Effect != policyDeny {
+		return AppError{ErrorCode: "invalid_input", Message: "effect of policy must be allow or deny"}
+	}
+	for i, method := range p.Methods {
+		p.Methods[i] = strings.ToUpper(method)
+	}
+	ipNets, err := parseIPNets(p.ClientIPs)
+	if err != nil {
+		return AppError{ErrorCode: "invalid_input", Message: "client_ips of policy is invalid: " + err.Error()}
+	}
+	p.ipNets = ipNets
+	return nil
+}
+
+func (p *policy) isMatch(consumer Consumer, req *http.Request, clientIP string) bool {
+	if len(p.Roles) > 0 && !containsAny(p.Roles, consumer.Roles) {
+		return false
+	}
+	if len(p.Scopes) > 0 && !containsAny(p.Scopes, consumer.Scopes) {
+		return false
+	}
+	if len(p.Apps) > 0 && !contains(p.Apps, consumer.App) {
+		return false
+	}
+	if len(p.Consumers) > 0 && !contains(p.Consumers, consumer.ID) {
+		return false
+	}
+	for key, value := range p.CustomFields {
+		if consumer.CustomFields[key] != value {
+			return false
+		}
+	}
+	if len(p.Methods) > 0 && !contains(p.Methods, req.Method) {
+		return false
+	}
+	if len(p.ClientIPs) > 0 && !containsIP(p.ipNets, clientIP) {
+		return false
+	}
+	return true
+}
+
+func containsAny(s []string, values []string) bool {
+	for _, value := range values {
+		if contains(s, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluatePolicies returns whether the request is allowed and the index of the matched rule.
+// The first matched rule wins.  When nothing matches, the request is denied if there is any allow rule,
+// otherwise it is allowed.  -1 means no rule was matched.
+func evaluatePolicies(policies []*policy, consumer Consumer, req *http.Request) (bool, int) {
+	clientIP := getAccessControlIP(req)
+	hasAllowRule := false
+	for i, p := range policies {
+		if p.Effect == policyAllow {
+			hasAllowRule = true
+		}
+		if p.isMatch(consumer, req, clientIP) {
+			return p.Effect == policyAllow, i
+		}
+	}
+	return !hasAllowRule, -1
+}
+
+// checkPolicies runs the policy engine of the api entry, the denied requests are only logged in audit mode.
+func (a *api) checkPolicies(consumer Consumer, req *http.Request) bool {
+	if len(a.Policies) == 0 {
+		return true
+	}
+	allowed, rule := evaluatePolicies(a.Policies, consumer, req)
+	if allowed {
+		return true
+	}
+
+	decision := "api: " + a.Name + ", consumer: " + consumer.ID + ", method: " + req.Method +
+		", path: " + req.URL.Path + ", client_ip: " + getAccessControlIP(req) + ", rule: " + strconv.Itoa(rule)
+	if a.PolicyMode == policyModeAudit {
+		_logger.infof("policy would deny the request: %s", decision)
+		return true
+	}
+	_logger.debugf("policy denied the request: %s", decision)
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestPolicyIsValid(t *testing.T) {
+	tests := []struct {
+		policy  policy
+		wantErr bool
+	}{
+		{policy{Effect: "Allow", Methods: []string{"get"}}, false},
+		{policy{Effect: policyDeny, ClientIPs: []string{"10.0.0.0/8", "::1"}}, false},
+		{policy{Effect: "permit"}, true},
+		{policy{Effect: policyDeny, ClientIPs: []string{"10.0.0.0/33"}}, true},
+	}
+	for _, tt := range tests {
+		p := tt.policy
+		if err := p.isValid(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, wantErr %v", tt.policy, err, tt.wantErr)
+		}
+	}
+	if err := (&api{Name: "users", RequestHost: "*", RequestPath: "/users", PolicyMode: "log"}).isValid(); err == nil {
+		t.Error("the unknown policy mode is valid")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	_config = newConfiguration()
+	_config.TrustedProxies = []string{"127.0.0.1"}
+	if err := _config.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	newPolicies := func() []*policy {
+		return []*policy{
+			{Effect: policyDeny, ClientIPs: []string{"1.1.1.0/24"}},
+			{Effect: policyDeny, Roles: []string{"member"}, Methods: []string{"delete"}},
+			{Effect: policyAllow, Roles: []string{"member", "admin"}},
+			{Effect: policyAllow, Scopes: []string{"orders.read"}, Methods: []string{"get"}},
+		}
+	}
+	apis := []*api{
+		{Name: "orders", RequestHost: "*", RequestPath: "/orders", Policies: newPolicies()},
+		{Name: "audit", RequestHost: "*", RequestPath: "/audit", Policies: newPolicies(), PolicyMode: policyModeAudit},
+		// without allow rules, the requests which don't match a deny rule are allowed
+		{Name: "public", RequestHost: "*", RequestPath: "/public", Policies: []*policy{{Effect: policyDeny, Methods: []string{"delete"}}}},
+	}
+	for _, apiEntry := range apis {
+		if err := apiEntry.isValid(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupTestRoutes(t, nil, apis)
+	ok := func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.SetStatus(200)
+	}
+	gateways := map[string]string{}
+	for _, consumer := range []Consumer{
+		{},
+		{ID: "a1", Roles: []string{"admin"}},
+		{ID: "m1", Roles: []string{"member"}},
+		{ID: "r1", Scopes: []string{"orders.read"}},
+	} {
+		gateways[consumer.ID] = newTestGateway(t, consumer, authorization, ok).URL
+	}
+
+	tests := []struct {
+		consumer     string
+		method       string
+		path         string
+		forwardedFor string
+		want         int
+	}{
+		{"m1", "GET", "/orders", "", 200},
+		{"m1", "DELETE", "/orders", "", 403},
+		{"a1", "DELETE", "/orders", "", 200},
+		// the first matched rule wins
+		{"a1", "GET", "/orders", "1.1.1.1", 403},
+		{"r1", "GET", "/orders", "", 200},
+		{"r1", "POST", "/orders", "", 403},
+		{"", "GET", "/orders", "", 401},
+		// audit mode only logs the denied requests
+		{"m1", "DELETE", "/audit", "", 200},
+		{"", "GET", "/audit", "1.1.1.1", 200},
+		{"", "GET", "/public", "", 200},
+		{"a1", "DELETE", "/public", "", 403},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, gateways[tt.consumer]+tt.path, nil)
+		if len(tt.forwardedFor) > 0 {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s of %q from %q: got %d, want %d", tt.method, tt.path, tt.consumer, tt.forwardedFor, resp.StatusCode, tt.want)
+		}
+	}
+	_config = newConfiguration()
+}
@@ -2,28 +2,34 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jasonsoft/napnap"
 )
 
+const (
+	copyBufferSize   = 32 * 1024
+	maxErrorBodySize = 64 * 1024
+)
+
 type proxy struct {
-	client      *http.Client
+	sync.Mutex
+	clients     map[clientKey]*http.Client
 	hopHeaders  []string
 	corsHeaders []string
 }
 
 func newProxy() *proxy {
-	p := &proxy{}
-
-	p.client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 20,
-		},
-		Timeout: time.Duration(30) * time.Second,
+	p := &proxy{
+		clients: map[clientKey]*http.Client{},
 	}
 
 	// Hop-by-hop headers. These are removed when sent to the backend.
@@ -57,35 +63,14 @@ func (p *proxy) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
 	_logger.debugf("request host: %v", c.Request.Host)
 	_logger.debugf("request path: %v", c.Request.URL.Path)
 
-	//requestHost := strings.ToLower(c.Request.Host)
-	requestPath := strings.ToLower(c.Request.URL.Path)
-
 	consumer := c.MustGet("consumer").(Consumer)
 
 	// find api entry which match the request.
+	route := matchedRoute(c)
 	var apiEntry *api
-	for _, apiElement := range _apis {
-		// ensure request host is match
-		if apiElement.RequestHost != "*" && !strings.EqualFold(apiElement.RequestHost, c.Request.Host) {
-			continue
-		}
-		// ensure request path is match
-		if apiElement.RequestPath != "*" && strings.HasPrefix(requestPath, apiElement.RequestPath) == false {
-			continue
-		}
-		// ensure the consumer has access permission
-		if apiElement.isAllow(consumer) == false {
-			if consumer.isAuthenticated() {
-				c.SetStatus(403)
-				return
-			}
-			c.SetStatus(401)
-			return
-		}
-		apiEntry = apiElement
-		break
+	if route != nil {
+		apiEntry = route.api
 	}
-
 	// none of api enties are match
 	if apiEntry == nil {
 		next(c) // go to notFound middleware
@@ -95,79 +80,328 @@ func (p *proxy) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
 	_logger.debugf("api host: %s", apiEntry.RequestHost)
 	_logger.debugf("api path: %s", apiEntry.RequestPath)
 
-	var targetURL string
+	// the service is picked before cache lookup, because the services of traffic split are cached separately
+	serviceName := apiEntry.serviceName(c.Request, consumer)
+	if len(serviceName) > 0 {
+		c.Set("service", serviceName)
+	}
+
+	// serve the fresh response from cache, stale one is revalidated by upstream
+	var cacheKey string
+	var cached *cachedResponse
+	if apiEntry.Cache != nil && apiEntry.Cache.isCacheable(c.Request) {
+		cacheKey = apiEntry.Cache.key(apiEntry, serviceName, c.Request, consumer)
+		cached = lookupCache(cacheKey, c.Request)
+		if cached != nil && cached.isFresh(time.Now()) && !parseCacheControl(c.Request.Header)["no-cache"] {
+			p.serveCache(c, cached, route, consumer, cacheHit)
+			return
+		}
+	}
+
 	var svcEntry *service
-	var upstreamEntry *upstream
-	if len(apiEntry.Service) > 0 {
-		for _, svcElement := range _services {
-			if apiEntry.Service == svcElement.Name {
-				svcEntry = svcElement
-			}
+	if len(serviceName) > 0 {
+		svcEntry = currentRoutes().service(serviceName)
+		if svcEntry != nil && !svcEntry.allowRequest() {
+			// circuit breaker is open
+			c.SetStatus(503)
+			return
 		}
+	}
+
+	policy := apiEntry.Retry
+	if policy == nil {
+		policy = defaultRetryPolicy
+	}
+
+	// api timeouts override service timeouts which override the config file
+	timeouts := _config.Timeouts
+	if svcEntry != nil {
+		timeouts = timeouts.merge(svcEntry.Timeouts)
+	}
+	timeouts = timeouts.merge(apiEntry.Timeouts)
+	client := p.clientFor(timeouts, upstreamProtocol(apiEntry, svcEntry, c.Request))
+
+	// send the copy of the request to mirror, the status of the original one is compared later
+	if apiEntry.Mirror != nil {
+		if primary := p.startMirror(c, route, consumer, timeouts); primary != nil {
+			startTime := time.Now()
+			defer func() {
+				primary <- mirrorResult{status: c.Writer.Status(), duration: time.Since(startTime)}
+			}()
+		}
+	}
+	body := newRequestBody(c.Request, policy)
+
+	// the upstream request is canceled when the client goes away
+	ctx := c.Request.Context()
+	if timeouts.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeoutDuration(timeouts.RequestTimeout))
+		defer cancel()
+	}
+
+	var resp *http.Response
+	var err error
+	var tried []*upstream
+	// every try is finished before the next one starts, the last one after its response was sent
+	cancelTry := func() {}
+	releaseTry := func() {}
+	defer func() {
+		cancelTry()
+		releaseTry()
+	}()
+	for attempt := 1; ; attempt++ {
+		var targetURL string
+		var upstreamEntry *upstream
 		if svcEntry != nil {
 			// get upstream and exchange url
-			upstreamEntry = svcEntry.askForUpstream()
+			key := svcEntry.hashKey(c.Request, consumer, getClientIP(c.Request))
+			upstreamEntry = svcEntry.askForUpstream(key, tried)
 			if upstreamEntry != nil {
+				releaseTry = func() { svcEntry.releaseUpstream(upstreamEntry) }
+				tried = append(tried, upstreamEntry)
 				_logger.debugf("upstream: %v", upstreamEntry.Name)
 				targetURL = upstreamEntry.TargetURL
 			}
+		}
 
+		if upstreamEntry == nil && len(apiEntry.TargetURL) > 0 {
+			_logger.debugf("api entry target url: %v", apiEntry.TargetURL)
+			targetURL = apiEntry.TargetURL
+		}
+
+		if len(targetURL) == 0 {
+			// no upstreams are available
+			c.SetStatus(503)
+			return
+		}
+
+		url := p.buildURL(route, targetURL, c.Request)
+		_logger.debugf("URL: %s", url)
+
+		// redirect if needed
+		if apiEntry.Redirect {
+			_logger.debug("redirect to ", url)
+			c.Redirect(301, url)
+			return
 		}
+
+		outReq := p.newOutRequest(c, consumer, url, body.open())
+		if apiEntry.Rewrite != nil && len(apiEntry.Rewrite.Host) > 0 {
+			outReq.Host = apiEntry.Rewrite.Host
+		}
+		if apiEntry.Headers != nil {
+			apiEntry.Headers.Request.apply(outReq.Header, newTemplateVars(c, consumer, route))
+		}
+		if cached != nil {
+			cached.setValidators(outReq.Header)
+		}
+
+		// websocket and other protocols which need to switch the connection
+		if isUpgradeRequest(c.Request) {
+			p.serveUpgrade(c, route, consumer, outReq, timeouts)
+			return
+		}
+
+		// send to target
+		var tryCtx context.Context
+		tryCtx, cancelTry = policy.tryContext(ctx)
+		resp, err = client.Do(outReq.WithContext(tryCtx))
+		// the upstream isn't blamed when the client has gone away
+		if svcEntry != nil && upstreamEntry != nil && c.Request.Context().Err() == nil {
+			// connect failures are reported as well, the upstream which is down is ejected by outlier detection
+			// or marked down by health check, it is never removed from the service by requests.
+			svcEntry.reportResult(upstreamEntry, err == nil && resp.StatusCode < 500)
+		}
+
+		if attempt >= policy.MaxAttempts || !body.canReplay() || !policy.shouldRetry(c.Request, resp, err) {
+			break
+		}
+		if err == nil {
+			respClose(resp.Body)
+		}
+		cancelTry()
+		releaseTry()
+		releaseTry = func() {}
+		_logger.debugf("retry: %d", attempt)
+		if err = policy.backoff(ctx, attempt); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		c.Set("error", err.Error())
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(c)
+			return
+		}
+		if isConnectError(err) || isTimeoutError(err) {
+			_logger.debugf("upstream is unavailable: %v", err)
+			c.SetStatus(504)
+			return
+		}
+		_logger.debugf("upstream error: %v", err)
+		c.SetStatus(502)
+		return
 	}
+	defer respClose(resp.Body)
 
-	if (svcEntry == nil || upstreamEntry == nil) && len(apiEntry.TargetURL) > 0 {
-		_logger.debugf("api entry target url: %v", apiEntry.TargetURL)
-		targetURL = apiEntry.TargetURL
+	if cached != nil && resp.StatusCode == 304 {
+		// the cached response is still valid
+		now := time.Now()
+		cached = cached.revalidated(resp.Header, apiEntry.Cache, now)
+		storeCache(cacheKey, cached, now)
+		p.serveCache(c, cached, route, consumer, cacheRevalidated)
+		return
+	}
+
+	// set error message
+	var respBody io.Reader = resp.Body
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 400) {
+		// error responses are small, so we only keep the beginning of the body for logging
+		errBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		respBody = io.MultiReader(bytes.NewReader(errBody), resp.Body)
+		c.Set("status_code", resp.StatusCode)
+		err := string(errBody)
+		c.Set("error", err)
+		_logger.debugf("error: %v", err)
 	}
 
-	if len(targetURL) == 0 {
-		// no upstreams are available
-		c.SetStatus(503)
+	if _config.CustomErrors && resp.StatusCode == 500 {
+		// don't write the message when custom error turns on
 		return
 	}
 
-	var url string
-	if apiEntry.StripRequestPath {
-		prefix := strings.ToLower(apiEntry.RequestPath)
-		newPath := c.Request.URL.Path
-		if strings.HasPrefix(requestPath, prefix) {
-			newPath = c.Request.URL.Path[len(prefix):]
+	// copy the response header, Cache-Control is kept for the api entries with cache
+	cacheControl := resp.Header["Cache-Control"]
+	p.removeHeader(resp.Header)
+	// announce the trailers, so they can be sent after the body
+	for name := range resp.Trailer {
+		resp.Header.Add("Trailer", name)
+	}
+	if apiEntry.Cache != nil && len(cacheControl) > 0 {
+		resp.Header["Cache-Control"] = cacheControl
+	}
+	if len(cacheKey) > 0 {
+		respBody = p.cacheResponse(c, cacheKey, apiEntry.Cache, resp, respBody)
+	}
+	if _config.Gzip.Enable && isStreamed(resp) && len(resp.Header.Get("Content-Encoding")) == 0 {
+		// the streamed data must not wait in the buffer of gzip, gzip writes the data as it is without Content-Encoding
+		c.Writer.Header().Del("Content-Encoding")
+	}
+	p.copyHeader(c.Writer.Header(), resp.Header)
+	if apiEntry.Headers != nil {
+		apiEntry.Headers.Response.apply(c.Writer.Header(), newTemplateVars(c, consumer, route))
+	}
+	if resp.ContentLength >= 0 && !_config.Gzip.Enable {
+		c.Writer.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	// write body
+	c.SetStatus(resp.StatusCode)
+	err = p.copyResponse(c.Writer, respBody, p.flusherFor(c, resp))
+	if err != nil {
+		// the client has gone away or the upstream broke the connection in the middle of the body,
+		// the status code was already sent so we can only log it.
+		_logger.debugf("copy response failed: %v", err)
+	}
+
+	// the trailers are known after the body was read, e.g. grpc-status
+	if len(resp.Trailer) > 0 {
+		for name, values := range resp.Trailer {
+			for _, value := range values {
+				c.Writer.Header().Add(http.TrailerPrefix+name, value)
+			}
 		}
-		url = targetURL + newPath
-	} else {
-		url = targetURL + c.Request.URL.Path
 	}
+	if isGRPCRequest(c.Request) {
+		recordGRPCStatus(c, resp)
+	}
+}
 
-	rawQuery := c.Request.URL.RawQuery
-	if len(rawQuery) > 0 {
-		url += "?" + rawQuery
+// clientKey is the settings which need different http clients.
+type clientKey struct {
+	timeouts TimeoutSetting
+	protocol string
+}
+
+// clientFor returns the http client which uses the timeouts and protocol.  Clients are shared by requests with
+// the same settings, so the connection pool is reused.
+func (p *proxy) clientFor(timeouts TimeoutSetting, protocol string) *http.Client {
+	// request timeout is applied with context, so it doesn't need a new client
+	timeouts.RequestTimeout = 0
+
+	p.Lock()
+	defer p.Unlock()
+
+	key := clientKey{timeouts: timeouts, protocol: protocol}
+	client, ok := p.clients[key]
+	if ok {
+		return client
+	}
+	dialer := &net.Dialer{
+		Timeout:   timeoutDuration(timeouts.ConnectTimeout),
+		KeepAlive: time.Duration(30) * time.Second,
 	}
+	client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConnsPerHost:   timeouts.MaxIdleConnsPerHost,
+			ResponseHeaderTimeout: timeoutDuration(timeouts.ResponseHeaderTimeout),
+			Protocols:             newTransportProtocols(protocol),
+		},
+	}
+	p.clients[key] = client
+	return client
+}
 
-	_logger.debugf("URL: %s", url)
+// buildURL returns the upstream url of the request.
+func (p *proxy) buildURL(route *routeMatch, targetURL string, req *http.Request) string {
+	var path string
+	if len(route.api.UpstreamPath) > 0 {
+		path = expandPath(route.api.UpstreamPath, route.params)
+	} else if route.api.StripRequestPath {
+		path = req.URL.Path[len(route.prefix):]
+	} else {
+		path = req.URL.Path
+	}
 
-	// redirect if needed
-	if apiEntry.Redirect {
-		_logger.debug("redirect to ", url)
-		c.Redirect(301, url)
-		return
+	rawQuery := req.URL.RawQuery
+	if route.api.Rewrite != nil {
+		path = route.api.Rewrite.rewritePath(route, path, req.URL.Path)
+		rawQuery = route.api.Rewrite.rewriteQuery(route, rawQuery)
 	}
 
-	method := c.Request.Method
-	body, _ := ioutil.ReadAll(c.Request.Body)
+	url := targetURL + path
+	if len(rawQuery) > 0 {
+		url += "?" + rawQuery
+	}
+	return url
+}
 
-	outReq, err := http.NewRequest(method, url, bytes.NewReader(body))
+// newOutRequest creates the request which is sent to upstream.
+func (p *proxy) newOutRequest(c *napnap.Context, consumer Consumer, url string, body io.Reader) *http.Request {
+	outReq, err := http.NewRequest(c.Request.Method, url, body)
 	if err != nil {
 		panic(err)
 	}
+	if body != nil && outReq.ContentLength == 0 {
+		// the body is streamed from client
+		outReq.ContentLength = c.Request.ContentLength
+	}
 
 	// copy the request header
 	p.copyHeader(outReq.Header, c.Request.Header)
 	p.removeHeader(outReq.Header)
+	// "TE: trailers" is required by gRPC, the request trailers are filled after the body was read
+	if strings.Contains(strings.ToLower(c.Request.Header.Get("Te")), "trailers") {
+		outReq.Header.Set("Te", "trailers")
+	}
+	outReq.Trailer = c.Request.Trailer
 
 	// forward reuqest ip
 	if _config.ForwardRequestIP {
-		clientIP := getClientIP(c.RemoteIPAddress())
-		outReq.Header.Set("X-Forwarded-For", clientIP)
+		setForwardedHeaders(c, outReq)
 	}
 
 	// forward reuqest id
@@ -215,51 +449,60 @@ func (p *proxy) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
 		outReq.Header.Set("X-Token", token)
 	}
 
-	// send to target
-	resp, err := p.client.Do(outReq)
-	if err != nil {
-		// upsteam server is down
-		if strings.Contains(err.Error(), "No connection could be made") {
-			if svcEntry != nil && upstreamEntry != nil {
-				svcEntry.unregisterUpstream(upstreamEntry)
-				p.Invoke(c, next) // resend
-				return
-			}
-			c.SetStatus(504)
-			return
-		}
-		// upstream server is timeout
-		if strings.Contains(err.Error(), "request canceled") {
-			_logger.debug("request canceled")
-			c.SetStatus(504)
-			return
-		}
-		panic(err)
-	}
-	defer respClose(resp.Body)
+	return outReq
+}
 
-	body, _ = ioutil.ReadAll(resp.Body)
+type rawWriterKey struct{}
 
-	// set error message
-	if !(resp.StatusCode >= 200 && resp.StatusCode < 400) {
-		c.Set("status_code", resp.StatusCode)
-		err := string(body)
-		c.Set("error", err)
-		_logger.debugf("error: %v", err)
-	}
+// withRawWriter keeps the writer of http server in the request context.  The writers of napnap can't be flushed,
+// so the proxy flushes the writer of http server, napnap writes the data to it without buffering.
+func withRawWriter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), rawWriterKey{}, w)))
+	})
+}
 
-	if _config.CustomErrors && resp.StatusCode == 500 {
-		// don't write the message when custom error turns on
-		return
-	}
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
 
-	// copy the response header
-	p.removeHeader(resp.Header)
-	p.copyHeader(c.Writer.Header(), resp.Header)
+// isStreamed reports whether the response needs to be sent to the client as soon as data arrives, e.g. chunked
+// or server-sent events responses.
+func isStreamed(resp *http.Response) bool {
+	return resp.ContentLength == -1 || isEventStream(resp)
+}
 
-	// write body
-	c.SetStatus(resp.StatusCode)
-	c.Writer.Write(body)
+// flusherFor returns the flusher of the streamed response, nil is returned when the response doesn't need it.
+func (p *proxy) flusherFor(c *napnap.Context, resp *http.Response) http.Flusher {
+	if !isStreamed(resp) {
+		return nil
+	}
+	flusher, _ := c.Request.Context().Value(rawWriterKey{}).(http.Flusher)
+	return flusher
+}
+
+// copyResponse streams the upstream response body to the client, the data is flushed after every write when
+// flusher isn't nil.
+func (p *proxy) copyResponse(dst io.Writer, src io.Reader, flusher http.Flusher) error {
+	buf := make([]byte, copyBufferSize)
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			_, werr := dst.Write(buf[:nr])
+			if werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
 }
 
 // CopyHeaders copies http headers from source to destination, it
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestProxyStreaming(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		streamed    bool
+	}{
+		{"server-sent events", "text/event-stream", true},
+		{"chunked", "application/json", true},
+		{"content length", "text/plain", false},
+	}
+	for _, tt := range tests {
+		done := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			if !tt.streamed {
+				w.Write([]byte("first\n"))
+				return
+			}
+			w.Write([]byte("first\n"))
+			w.(http.Flusher).Flush()
+			// the rest is sent after the client got the first line
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+			}
+			w.Write([]byte("second\n"))
+		}))
+
+		_config = newConfiguration()
+		_config.Gzip.Enable = true
+		setupTestRoutes(t, []*service{
+			{ID: "s1", Name: "events", Upstreams: []*upstream{{Name: "u1", TargetURL: server.URL}}},
+		}, []*api{
+			{Name: "events", RequestHost: "*", RequestPath: "/", Service: "events"},
+		})
+		gateway := newTestGateway(t, Consumer{}, newGzipMiddleware(napnap.DefaultCompression), newProxy().Invoke)
+
+		req, _ := http.NewRequest("GET", gateway.URL+"/events", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoding := resp.Header.Get("Content-Encoding")
+		if tt.streamed != (len(encoding) == 0) {
+			t.Errorf("%s: Content-Encoding = %q", tt.name, encoding)
+		}
+		if tt.streamed {
+			lines := make(chan string, 1)
+			go func() {
+				line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+				lines <- line
+			}()
+			select {
+			case line := <-lines:
+				if line != "first\n" {
+					t.Errorf("%s: got %q, want first line", tt.name, line)
+				}
+			case <-time.After(2 * time.Second):
+				t.Errorf("%s: the first line wasn't flushed", tt.name)
+			}
+		}
+		close(done)
+		resp.Body.Close()
+		server.Close()
+	}
+}
+
+func TestIsStreamed(t *testing.T) {
+	tests := []struct {
+		contentType   string
+		contentLength int64
+		want          bool
+	}{
+		{"text/event-stream", 100, true},
+		{"text/event-stream; charset=utf-8", -1, true},
+		{"application/json", -1, true},
+		{"application/json", 0, false},
+		{"text/html", 1024, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{"Content-Type": {tt.contentType}}, ContentLength: tt.contentLength}
+		if got := isStreamed(resp); got != tt.want {
+			t.Errorf("%s with length %d: got %v, want %v", tt.contentType, tt.contentLength, got, tt.want)
+		}
+	}
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	defer slow.Close()
+
+	tests := []struct {
+		name        string
+		config      TimeoutSetting
+		svcTimeouts *TimeoutSetting
+		apiTimeouts *TimeoutSetting
+		want        int
+	}{
+		{"request timeout of config file", TimeoutSetting{RequestTimeout: 100}, nil, nil, 504},
+		{"service overrides config file", TimeoutSetting{RequestTimeout: 100}, &TimeoutSetting{RequestTimeout: 1000}, nil, 200},
+		{"api overrides service", TimeoutSetting{RequestTimeout: 1000}, &TimeoutSetting{RequestTimeout: 1000}, &TimeoutSetting{RequestTimeout: 100}, 504},
+		{"api disables the timeout", TimeoutSetting{RequestTimeout: 100}, &TimeoutSetting{RequestTimeout: 100}, &TimeoutSetting{RequestTimeout: noTimeout}, 200},
+		{"response header timeout", TimeoutSetting{}, nil, &TimeoutSetting{ResponseHeaderTimeout: 100}, 504},
+	}
+	for _, tt := range tests {
+		_config = newConfiguration()
+		_config.Timeouts = tt.config
+		setupTestRoutes(t, []*service{
+			{ID: "s1", Name: "slow", Timeouts: tt.svcTimeouts, Upstreams: []*upstream{{Name: "u1", TargetURL: slow.URL}}},
+		}, []*api{
+			{Name: "slow", RequestHost: "*", RequestPath: "/slow", Service: "slow", Timeouts: tt.apiTimeouts},
+		})
+		gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+
+		status, body := getBody(t, gateway.URL+"/slow")
+		if status != tt.want || (tt.want == 200 && body != "done") {
+			t.Errorf("%s: got %d %q, want %d", tt.name, status, body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+	redis "gopkg.in/redis.v4"
+)
+
+const (
+	rateLimitByAPI      = "api"
+	rateLimitByConsumer = "consumer"
+	rateLimitByApp      = "app"
+	rateLimitByIP       = "ip"
+)
+
+// rateLimit is a token bucket which allows Rate requests per Period seconds and up to Burst requests at once.
+type rateLimit struct {
+	By     string   `json:"by" bson:"by"`
+	Roles  []string `json:"roles,omitempty" bson:"roles,omitempty"`
+	Rate   int      `json:"rate" bson:"rate"`
+	Period int      `json:"period" bson:"period"` // seconds
+	Burst  int      `json:"burst" bson:"burst"`
+}
+
+func (rl *rateLimit) isValid() error {
+	switch rl.By {
+	case "":
+		rl.By = rateLimitByConsumer
+	case rateLimitByAPI, rateLimitByConsumer, rateLimitByApp, rateLimitByIP:
+	default:
+		return AppError{ErrorCode: "invalid_input", Message: "rate limit by field is invalid"}
+	}
+	if rl.Rate <= 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "rate limit rate field must be greater than 0"}
+	}
+	if rl.Period <= 0 {
+		rl.Period = 1
+	}
+	if rl.Burst <= 0 {
+		rl.Burst = rl.Rate
+	}
+	return nil
+}
+
+// tokensPerSecond returns how fast the bucket is refilled.
+func (rl *rateLimit) tokensPerSecond() float64 {
+	return float64(rl.Rate) / float64(rl.Period)
+}
+
+// isMatch reports whether the limit applies to the consumer.
+func (rl *rateLimit) isMatch(consumer Consumer) bool {
+	if len(rl.Roles) == 0 {
+		return true
+	}
+	for _, role := range consumer.Roles {
+		if contains(rl.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// name identifies the bucket of the limit by its settings rather than its position, so the counters of other
+// limits are kept when a limit is added or removed.
+func (rl *rateLimit) name() string {
+	name := rl.By + ":" + strconv.Itoa(rl.Rate) + "/" + strconv.Itoa(rl.Period) + ":" + strconv.Itoa(rl.Burst)
+	if len(rl.Roles) > 0 {
+		roles := append([]string{}, rl.Roles...)
+		sort.Strings(roles)
+		name += ":" + strings.Join(roles, ",")
+	}
+	return name
+}
+
+// counterKey returns the key of the bucket, anonymous requests are counted by client ip.
+func (rl *rateLimit) counterKey(apiEntry *api, consumer Consumer, clientIP string) string {
+	prefix := "ratelimit:api:" + apiEntry.ID + ":" + rl.name() + ":"
+	switch rl.By {
+	case rateLimitByAPI:
+		return prefix + "all"
+	case rateLimitByApp:
+		if len(consumer.App) > 0 {
+			return prefix + "app:" + consumer.App
+		}
+	case rateLimitByConsumer:
+		if consumer.isAuthenticated() {
+			return prefix + "consumer:" + consumer.ID
+		}
+	}
+	return prefix + "ip:" + clientIP
+}
+
+type rateLimitResult struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      int // seconds until the bucket is full
+	retryAfter int // seconds until next request is allowed
+}
+
+func newRateLimitResult(rl *rateLimit, allowed bool, tokens float64) rateLimitResult {
+	rate := rl.tokensPerSecond()
+	result := rateLimitResult{
+		allowed:   allowed,
+		limit:     rl.Burst,
+		remaining: int(math.Floor(tokens)),
+		reset:     int(math.Ceil((float64(rl.Burst) - tokens) / rate)),
+	}
+	if !allowed {
+		result.retryAfter = int(math.Ceil((1 - tokens) / rate))
+	}
+	return result
+}
+
+type RateLimitRepository interface {
+	Take(key string, rl *rateLimit) (rateLimitResult, error)
+}
+
+type rateLimitMiddleware struct {
+}
+
+func newRateLimitMiddleware() *rateLimitMiddleware {
+	return &rateLimitMiddleware{}
+}
+
+func (m *rateLimitMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	apiEntry := matchedAPI(c)
+	if apiEntry == nil {
+		next(c)
+		return
+	}
+	consumer := c.MustGet("consumer").(Consumer)
+	// forwarding headers of untrusted clients could get a new bucket for every request
+	clientIP := getAccessControlIP(c.Request)
+
+	var result *rateLimitResult
+	take := func(key string, rl *rateLimit) {
+		r, err := _rateLimitRepo.Take(key, rl)
+		if err != nil {
+			// we don't block the request when the counter is unavailable
+			_logger.errorf("rate limit error: %v", err)
+			return
+		}
+		if result == nil || !r.allowed || (result.allowed && r.remaining < result.remaining) {
+			result = &r
+		}
+	}
+
+	for _, rl := range apiEntry.RateLimits {
+		if rl.isMatch(consumer) {
+			take(rl.counterKey(apiEntry, consumer, clientIP), rl)
+		}
+	}
+	for _, rl := range consumer.RateLimits {
+		take("ratelimit:consumer:"+consumer.ID+":"+rl.name(), rl)
+	}
+
+	if result == nil {
+		next(c)
+		return
+	}
+
+	c.RespHeader("X-RateLimit-Limit", strconv.Itoa(result.limit))
+	c.RespHeader("X-RateLimit-Remaining", strconv.Itoa(result.remaining))
+	c.RespHeader("X-RateLimit-Reset", strconv.Itoa(result.reset))
+	if !result.allowed {
+		c.RespHeader("Retry-After", strconv.Itoa(result.retryAfter))
+		c.Set("error", "rate limit exceeded")
+		c.JSON(429, AppError{ErrorCode: "too_many_requests", Message: "API rate limit exceeded."})
+		return
+	}
+	next(c)
+}
+
+/*********************
+	Memory
+*********************/
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	expireAt  time.Time
+}
+
+type RateLimitMemStore struct {
+	sync.Mutex
+	data map[string]*tokenBucket
+}
+
+func newRateLimitMemStore() *RateLimitMemStore {
+	store := &RateLimitMemStore{
+		data: map[string]*tokenBucket{},
+	}
+	go store.cleanup()
+	return store
+}
+
+func (rs *RateLimitMemStore) Take(key string, rl *rateLimit) (rateLimitResult, error) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	now := time.Now()
+	bucket, ok := rs.data[key]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens:    float64(rl.Burst),
+			updatedAt: now,
+		}
+		rs.data[key] = bucket
+	}
+
+	rate := rl.tokensPerSecond()
+	bucket.tokens = math.Min(float64(rl.Burst), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate)
+	bucket.updatedAt = now
+	// the bucket is full again after this time, so it can be removed
+	bucket.expireAt = now.Add(time.Duration(float64(rl.Burst)/rate*float64(time.Second)) + time.Second)
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	return newRateLimitResult(rl, allowed, bucket.tokens), nil
+}
+
+// cleanup removes full buckets periodically, otherwise the store grows with every client ip.
+func (rs *RateLimitMemStore) cleanup() {
+	for {
+		time.Sleep(1 * time.Minute)
+		now := time.Now()
+		rs.Lock()
+		for key, bucket := range rs.data {
+			if now.After(bucket.expireAt) {
+				delete(rs.data, key)
+			}
+		}
+		rs.Unlock()
+	}
+}
+
+/*********************
+	Redis Database
+*********************/
+
+// tokenBucketScript refills and takes a token atomically, so the counters can be shared by gateway nodes.
+// The time of redis is used, so the clocks of gateway nodes don't need to agree.
+var tokenBucketScript = redis.NewScript(`
+redis.replicate_commands()
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local data = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(data[1])
+local ts = tonumber(data[2])
+if tokens == nil then
+	tokens = capacity
+	ts = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+type rateLimitRedis struct {
+	client *redis.Client
+}
+
+func newRateLimitRedis(addr string, password string, db int) (*rateLimitRedis, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	rateLimitRedis := &rateLimitRedis{
+		client: client,
+	}
+	return rateLimitRedis, nil
+}
+
+func (source *rateLimitRedis) Take(key string, rl *rateLimit) (rateLimitResult, error) {
+	rate := strconv.FormatFloat(rl.tokensPerSecond(), 'f', -1, 64)
+	val, err := tokenBucketScript.Run(source.client, []string{key}, rl.Burst, rate).Result()
+	if err != nil {
+		return rateLimitResult{allowed: true}, err
+	}
+
+	reply, ok := val.([]interface{})
+	if !ok || len(reply) != 2 {
+		return rateLimitResult{allowed: true}, AppError{ErrorCode: "unknown_error", Message: "unexpected rate limit reply"}
+	}
+	allowed, _ := reply[0].(int64)
+	tokensStr, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(strings.TrimSpace(tokensStr), 64)
+	if err != nil {
+		return rateLimitResult{allowed: true}, err
+	}
+	return newRateLimitResult(rl, allowed == 1, tokens), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestRateLimitIsValid(t *testing.T) {
+	tests := []struct {
+		rl      rateLimit
+		wantErr bool
+		want    rateLimit
+	}{
+		{rateLimit{Rate: 10}, false, rateLimit{By: rateLimitByConsumer, Rate: 10, Period: 1, Burst: 10}},
+		{rateLimit{By: rateLimitByIP, Rate: 5, Period: 60, Burst: 2}, false, rateLimit{By: rateLimitByIP, Rate: 5, Period: 60, Burst: 2}},
+		{rateLimit{By: "host", Rate: 10}, true, rateLimit{}},
+		{rateLimit{Rate: 0}, true, rateLimit{}},
+	}
+	for _, tt := range tests {
+		rl := tt.rl
+		err := rl.isValid()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, wantErr %v", tt.rl, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (rl.By != tt.want.By || rl.Period != tt.want.Period || rl.Burst != tt.want.Burst) {
+			t.Errorf("%+v: got %+v, want %+v", tt.rl, rl, tt.want)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		rl      rateLimit
+		elapsed time.Duration // since the previous request
+		times   int
+		want    []bool
+	}{
+		{"burst", rateLimit{Rate: 1, Period: 1, Burst: 3}, 0, 4, []bool{true, true, true, false}},
+		{"refill", rateLimit{Rate: 1, Period: 1, Burst: 1}, time.Second, 3, []bool{true, true, true}},
+		{"slow refill", rateLimit{Rate: 1, Period: 10, Burst: 1}, time.Second, 3, []bool{true, false, false}},
+		{"capped refill", rateLimit{Rate: 10, Period: 1, Burst: 2}, time.Hour, 3, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		store := &RateLimitMemStore{data: map[string]*tokenBucket{}}
+		for i := 0; i < tt.times; i++ {
+			if bucket, ok := store.data["key"]; ok {
+				bucket.updatedAt = bucket.updatedAt.Add(-tt.elapsed)
+			}
+			result, err := store.Take("key", &tt.rl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.allowed != tt.want[i] {
+				t.Errorf("%s: request %d allowed = %v, want %v", tt.name, i+1, result.allowed, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestNewRateLimitResult(t *testing.T) {
+	rl := &rateLimit{Rate: 2, Period: 1, Burst: 10}
+	tests := []struct {
+		allowed bool
+		tokens  float64
+		want    rateLimitResult
+	}{
+		{true, 9, rateLimitResult{allowed: true, limit: 10, remaining: 9, reset: 1}},
+		{true, 0.5, rateLimitResult{allowed: true, limit: 10, remaining: 0, reset: 5}},
+		{false, 0.5, rateLimitResult{allowed: false, limit: 10, remaining: 0, reset: 5, retryAfter: 1}},
+		{false, 0, rateLimitResult{allowed: false, limit: 10, remaining: 0, reset: 5, retryAfter: 1}},
+	}
+	for _, tt := range tests {
+		if got := newRateLimitResult(rl, tt.allowed, tt.tokens); got != tt.want {
+			t.Errorf("allowed %v, tokens %v: got %+v, want %+v", tt.allowed, tt.tokens, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitCounterKey(t *testing.T) {
+	apiEntry := &api{ID: "a1"}
+	anonymous := Consumer{}
+	consumer := Consumer{ID: "c1", App: "web", Roles: []string{"member"}}
+
+	tests := []struct {
+		rl       rateLimit
+		consumer Consumer
+		want     string
+	}{
+		{rateLimit{By: rateLimitByAPI, Rate: 10, Period: 1, Burst: 10}, consumer, "ratelimit:api:a1:api:10/1:10:all"},
+		{rateLimit{By: rateLimitByConsumer, Rate: 10, Period: 1, Burst: 10}, consumer, "ratelimit:api:a1:consumer:10/1:10:consumer:c1"},
+		{rateLimit{By: rateLimitByConsumer, Rate: 10, Period: 1, Burst: 10}, anonymous, "ratelimit:api:a1:consumer:10/1:10:ip:10.0.0.1"},
+		{rateLimit{By: rateLimitByApp, Rate: 10, Period: 1, Burst: 10}, consumer, "ratelimit:api:a1:app:10/1:10:app:web"},
+		{rateLimit{By: rateLimitByApp, Rate: 10, Period: 1, Burst: 10}, anonymous, "ratelimit:api:a1:app:10/1:10:ip:10.0.0.1"},
+		{rateLimit{By: rateLimitByIP, Rate: 10, Period: 1, Burst: 10}, consumer, "ratelimit:api:a1:ip:10/1:10:ip:10.0.0.1"},
+		{rateLimit{By: rateLimitByIP, Rate: 5, Period: 60, Burst: 5, Roles: []string{"b", "a"}}, consumer, "ratelimit:api:a1:ip:5/60:5:a,b:ip:10.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := tt.rl.counterKey(apiEntry, tt.consumer, "10.0.0.1"); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitIsMatch(t *testing.T) {
+	tests := []struct {
+		roles []string
+		want  bool
+	}{
+		{nil, true},
+		{[]string{"member"}, true},
+		{[]string{"admin", "member"}, true},
+		{[]string{"admin"}, false},
+	}
+	consumer := Consumer{Roles: []string{"member"}}
+	for _, tt := range tests {
+		rl := &rateLimit{Roles: tt.roles}
+		if got := rl.isMatch(consumer); got != tt.want {
+			t.Errorf("roles %v: got %v, want %v", tt.roles, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	_config = newConfiguration()
+	_rateLimitRepo = &RateLimitMemStore{data: map[string]*tokenBucket{}}
+	setupTestRoutes(t, nil, []*api{
+		{ID: "a1", Name: "limited", RequestHost: "*", RequestPath: "/", RateLimits: []*rateLimit{{By: rateLimitByIP, Rate: 2, Period: 60}}},
+	})
+	ok := func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.SetStatus(200)
+	}
+	server := newTestGateway(t, Consumer{}, newRateLimitMiddleware().Invoke, ok)
+
+	tests := []struct {
+		forwardedFor string
+		wantStatus   int
+		wantLimit    string
+		wantRemain   string
+	}{
+		{"", 200, "2", "1"},
+		{"1.1.1.1", 200, "2", "0"},
+		// a new forwarded address doesn't get a new bucket
+		{"2.2.2.2", 429, "2", "0"},
+		{"3.3.3.3", 429, "2", "0"},
+	}
+	for i, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+"/", nil)
+		if len(tt.forwardedFor) > 0 {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus || resp.Header.Get("X-RateLimit-Limit") != tt.wantLimit || resp.Header.Get("X-RateLimit-Remaining") != tt.wantRemain {
+			t.Errorf("request %d: got %d with limit %s and remaining %s, want %d with %s and %s", i+1, resp.StatusCode,
+				resp.Header.Get("X-RateLimit-Limit"), resp.Header.Get("X-RateLimit-Remaining"), tt.wantStatus, tt.wantLimit, tt.wantRemain)
+		}
+		if tt.wantStatus == 429 && len(resp.Header.Get("Retry-After")) == 0 {
+			t.Errorf("request %d: Retry-After is missing", i+1)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+type originalBodyKey struct{}
+
+// withOriginalBody keeps the request body in the request context before napnap limits its size with
+// MaxRequestBodySize, so the limit of config file or api entry can be larger than the limit of napnap or
+// remove it.
+func withOriginalBody(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), originalBodyKey{}, req.Body)))
+	})
+}
+
+// requestLimitMiddleware rejects the requests which exceed the limits of config file or matched api entry,
+// and validates the request body against the json schema of api entry before it reaches upstream.
+func requestLimitMiddleware(c *napnap.Context, next napnap.HandlerFunc) {
+	apiEntry := matchedAPI(c)
+	limits := _config.Limits
+	if apiEntry != nil {
+		limits = limits.merge(apiEntry.Limits)
+	}
+	req := c.Request
+
+	if limits.MaxURLLength > 0 && len(req.RequestURI) > limits.MaxURLLength {
+		c.Set("error", "url is too long")
+		c.JSON(414, AppError{ErrorCode: "uri_too_long", Message: "The request url is too long."})
+		return
+	}
+
+	if limits.MaxHeaderCount > 0 || limits.MaxHeaderSize > 0 {
+		count, size := 0, 0
+		for name, values := range req.Header {
+			for _, value := range values {
+				count++
+				size += len(name) + len(value) + 4 // ": " and "\r\n"
+			}
+		}
+		if (limits.MaxHeaderCount > 0 && count > limits.MaxHeaderCount) || (limits.MaxHeaderSize > 0 && size > limits.MaxHeaderSize) {
+			c.Set("error", "request headers are too large")
+			c.JSON(431, AppError{ErrorCode: "header_too_large", Message: "The request headers are too large."})
+			return
+		}
+	}
+
+	// the limit replaces the default limit of napnap, no limit removes it
+	body := req.Body
+	if original, ok := req.Context().Value(originalBodyKey{}).(io.ReadCloser); ok {
+		body = original
+	}
+	if limits.MaxRequestBodySize > 0 {
+		if req.ContentLength > limits.MaxRequestBodySize {
+			writeBodyTooLarge(c)
+			return
+		}
+		// chunked body is checked while it is read
+		body = http.MaxBytesReader(c.Writer, body, limits.MaxRequestBodySize)
+	}
+	req.Body = body
+
+	if apiEntry != nil && apiEntry.schema != nil && hasRequestBody(req.Method) {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			if isBodyTooLarge(err) {
+				writeBodyTooLarge(c)
+				return
+			}
+			writeInvalidBody(c, "request body can't be read")
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		err = decoder.Decode(&value)
+		if err != nil || decoder.More() {
+			writeInvalidBody(c, "request body must be valid json")
+			return
+		}
+		err = apiEntry.schema.validate(value, "$")
+		if err != nil {
+			writeInvalidBody(c, "request body is invalid: "+err.Error())
+			return
+		}
+	}
+
+	next(c)
+}
+
+func hasRequestBody(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
+
+// isBodyTooLarge reports whether the error was returned by the body which exceeded MaxBytesReader.
+func isBodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "request body too large")
+}
+
+// writeInvalidBody writes the error response directly, because the public port has no middleware which
+// recovers panics unless gelf log is enabled.
+func writeInvalidBody(c *napnap.Context, message string) {
+	c.Set("error", message)
+	c.JSON(400, AppError{ErrorCode: "invalid_input", Message: message})
+}
+
+func writeBodyTooLarge(c *napnap.Context) {
+	c.Set("error", "request body is too large")
+	c.JSON(413, AppError{ErrorCode: "request_too_large", Message: "The request body is too large."})
+}
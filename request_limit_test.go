@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestLimitSettingMerge(t *testing.T) {
+	config := LimitSetting{MaxRequestBodySize: 1024, MaxHeaderCount: 10, MaxHeaderSize: 512, MaxURLLength: 100}
+	tests := []struct {
+		name  string
+		other *LimitSetting
+		want  LimitSetting
+	}{
+		{"nil", nil, config},
+		{"inherit", &LimitSetting{}, config},
+		{"override", &LimitSetting{MaxRequestBodySize: 2048, MaxURLLength: 50}, LimitSetting{MaxRequestBodySize: 2048, MaxHeaderCount: 10, MaxHeaderSize: 512, MaxURLLength: 50}},
+		{"no limit", &LimitSetting{MaxRequestBodySize: noLimit, MaxHeaderCount: noLimit}, LimitSetting{MaxRequestBodySize: noLimit, MaxHeaderCount: noLimit, MaxHeaderSize: 512, MaxURLLength: 100}},
+	}
+	for _, tt := range tests {
+		if got := config.merge(tt.other); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if err := (&LimitSetting{MaxRequestBodySize: -2}).isValid(); err == nil {
+		t.Error("-2 must be invalid")
+	}
+}
+
+func TestRequestLimitBodySize(t *testing.T) {
+	// larger than the default limit of napnap
+	const size = 11 << 20
+
+	tests := []struct {
+		name       string
+		config     int64
+		api        *LimitSetting
+		wantStatus int
+	}{
+		{"config limit", 10 << 20, nil, 413},
+		{"config without limit", 0, nil, 200},
+		{"api limit", 0, &LimitSetting{MaxRequestBodySize: 1 << 20}, 413},
+		{"api raises the limit", 10 << 20, &LimitSetting{MaxRequestBodySize: 12 << 20}, 200},
+		{"api removes the limit", 10 << 20, &LimitSetting{MaxRequestBodySize: noLimit}, 200},
+	}
+	for _, tt := range tests {
+		_config = newConfiguration()
+		_config.Limits.MaxRequestBodySize = tt.config
+		setupTestRoutes(t, nil, []*api{
+			{ID: "a1", Name: "upload", RequestHost: "*", RequestPath: "/", Limits: tt.api},
+		})
+		read := func(c *napnap.Context, next napnap.HandlerFunc) {
+			n, err := io.Copy(ioutil.Discard, c.Request.Body)
+			if err != nil {
+				if isBodyTooLarge(err) {
+					writeBodyTooLarge(c)
+					return
+				}
+				t.Fatal(err)
+			}
+			c.String(200, strconv.FormatInt(n, 10))
+		}
+		server := newTestGateway(t, Consumer{}, requestLimitMiddleware, read)
+
+		// the chunked body is checked while it is read
+		body := struct{ io.Reader }{bytes.NewReader(make([]byte, size))}
+		resp, err := http.Post(server.URL+"/", "application/octet-stream", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: got %d %s, want %d", tt.name, resp.StatusCode, got, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == 200 && string(got) != strconv.Itoa(size) {
+			t.Errorf("%s: upstream read %s bytes, want %d", tt.name, got, size)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	retryOnConnectFailure = "connect_failure"
+	retryOnTimeout        = "timeout"
+	retryOnReset          = "reset"
+	retryOn5xx            = "5xx"
+
+	// request bodies which are larger than this are streamed and can't be retried
+	maxRetryBodySize = 256 * 1024
+)
+
+// defaultRetryPolicy is used when the api entry doesn't have one.  Only connection failures are retried because
+// the request never reached the upstream.
+var defaultRetryPolicy = &retryPolicy{
+	MaxAttempts: 2,
+	RetryOn:     []string{retryOnConnectFailure},
+}
+
+type retryPolicy struct {
+	MaxAttempts        int      `json:"max_attempts" bson:"max_attempts"`
+	RetryOn            []string `json:"retry_on" bson:"retry_on"`
+	PerTryTimeout      int      `json:"per_try_timeout" bson:"per_try_timeout"` // milliseconds
+	Backoff            int      `json:"backoff" bson:"backoff"`                 // milliseconds
+	RetryNonIdempotent bool     `json:"retry_non_idempotent" bson:"retry_non_idempotent"`
+}
+
+func (rp *retryPolicy) isValid() error {
+	if rp.MaxAttempts < 0 || rp.PerTryTimeout < 0 || rp.Backoff < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "retry fields can't be negative"}
+	}
+	if rp.MaxAttempts == 0 {
+		rp.MaxAttempts = 1
+	}
+	for _, condition := range rp.RetryOn {
+		switch condition {
+		case retryOnConnectFailure, retryOnTimeout, retryOnReset, retryOn5xx:
+		default:
+			code, err := strconv.Atoi(condition)
+			if err != nil || code < 400 || code > 599 {
+				return AppError{ErrorCode: "invalid_input", Message: "retry_on field is invalid: " + condition}
+			}
+		}
+	}
+	return nil
+}
+
+func (rp *retryPolicy) retryOn(condition string) bool {
+	return contains(rp.RetryOn, condition)
+}
+
+// isIdempotent reports whether the request can be sent twice safely.  The other methods are retried only when
+// the api entry sets retry_non_idempotent.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// shouldRetry reports whether the request is sent again.  Non-idempotent requests are never retried unless
+// the policy allows it, even on connect failures.
+func (rp *retryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if !rp.RetryNonIdempotent && !isIdempotent(req) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		// the client has gone away
+		return false
+	}
+	if err != nil && isConnectError(err) {
+		return rp.retryOn(retryOnConnectFailure)
+	}
+	if err != nil {
+		if isTimeoutError(err) {
+			return rp.retryOn(retryOnTimeout)
+		}
+		return rp.retryOn(retryOnReset)
+	}
+	if resp.StatusCode >= 500 && rp.retryOn(retryOn5xx) {
+		return true
+	}
+	return rp.retryOn(strconv.Itoa(resp.StatusCode))
+}
+
+// tryContext returns the context of one attempt.
+func (rp *retryPolicy) tryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if rp.PerTryTimeout > 0 {
+		return context.WithTimeout(parent, time.Duration(rp.PerTryTimeout)*time.Millisecond)
+	}
+	return context.WithCancel(parent)
+}
+
+// backoff waits exponentially longer after each failed attempt, the error of ctx is returned when the request is
+// canceled or timed out while waiting.
+func (rp *retryPolicy) backoff(ctx context.Context, attempt int) error {
+	if rp.Backoff <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(time.Duration(rp.Backoff<<uint(attempt-1)) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func unwrapError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
+
+func isConnectError(err error) bool {
+	if opErr, ok := unwrapError(err).(*net.OpError); ok && opErr.Op == "dial" {
+		return true
+	}
+	return strings.Contains(err.Error(), "No connection could be made") || strings.Contains(err.Error(), "connection refused")
+}
+
+func isTimeoutError(err error) bool {
+	if netErr, ok := unwrapError(err).(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// requestBody keeps small request bodies in memory, so they can be sent again when we retry.
+type requestBody struct {
+	buf        []byte
+	rest       io.Reader
+	replayable bool
+	opened     bool
+}
+
+// newRequestBody buffers the body only when the request may be retried.  The bodies of unknown length are
+// streamed unless the api entry sets a retry policy, so the default policy doesn't delay chunked uploads.
+func newRequestBody(req *http.Request, policy *retryPolicy) *requestBody {
+	if req.ContentLength == 0 {
+		return &requestBody{replayable: true}
+	}
+	if policy.MaxAttempts <= 1 || req.ContentLength > maxRetryBodySize || isGRPCRequest(req) ||
+		(req.ContentLength < 0 && policy == defaultRetryPolicy) ||
+		(!policy.RetryNonIdempotent && !isIdempotent(req)) {
+		// streaming rpc must not be buffered
+		return &requestBody{rest: req.Body}
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRetryBodySize+1))
+	if err != nil || len(buf) > maxRetryBodySize {
+		// the body is too large or broken, we stream the rest of body and don't retry
+		return &requestBody{buf: buf, rest: req.Body}
+	}
+	return &requestBody{buf: buf, replayable: true}
+}
+
+// open returns the body for the next attempt.
+func (b *requestBody) open() io.Reader {
+	b.opened = true
+	if b.rest != nil {
+		if len(b.buf) > 0 {
+			return io.MultiReader(bytes.NewReader(b.buf), b.rest)
+		}
+		return b.rest
+	}
+	if len(b.buf) > 0 {
+		return bytes.NewReader(b.buf)
+	}
+	return nil
+}
+
+func (b *requestBody) canReplay() bool {
+	return b.replayable || !b.opened
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	policy := &retryPolicy{MaxAttempts: 3, RetryOn: []string{retryOnConnectFailure, retryOnTimeout, retryOn5xx, "429"}}
+	connectErr := errors.New("dial tcp 10.0.0.1:80: connect: connection refused")
+	timeoutErr := &timeoutError{}
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		status int
+		err    error
+		policy *retryPolicy
+		want   bool
+	}{
+		{"5xx", "GET", "", 503, nil, policy, true},
+		{"status", "GET", "", 429, nil, policy, true},
+		{"4xx", "GET", "", 404, nil, policy, false},
+		{"connect failure", "GET", "", 0, connectErr, policy, true},
+		{"timeout", "GET", "", 0, timeoutErr, policy, true},
+		{"deadline", "GET", "", 0, context.DeadlineExceeded, policy, true},
+		{"client gone", "GET", "", 0, context.Canceled, policy, false},
+		{"reset isn't set", "GET", "", 0, io.ErrUnexpectedEOF, policy, false},
+		{"post", "POST", "", 503, nil, policy, false},
+		{"post with idempotency key", "POST", "Idempotency-Key", 503, nil, policy, false},
+		{"post of non idempotent policy", "POST", "", 503, nil, &retryPolicy{RetryOn: []string{retryOn5xx}, RetryNonIdempotent: true}, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://example.com/", nil)
+		if len(tt.header) > 0 {
+			req.Header.Set(tt.header, "k1")
+		}
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+		if got := tt.policy.shouldRetry(req, resp, tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &retryPolicy{Backoff: 1000}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := policy.backoff(ctx, 3); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("backoff waited %v after the request timed out", elapsed)
+	}
+
+	if err := (&retryPolicy{Backoff: 1}).backoff(context.Background(), 1); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first two tries fail
+		if atomic.AddInt32(&hits, 1) <= 2 {
+			w.WriteHeader(503)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		retry      *retryPolicy
+		wantStatus int
+		wantHits   int32
+	}{
+		{"retried", "GET", &retryPolicy{MaxAttempts: 3, RetryOn: []string{retryOn5xx}}, 200, 3},
+		{"max attempts", "GET", &retryPolicy{MaxAttempts: 2, RetryOn: []string{retryOn5xx}}, 503, 2},
+		{"default policy", "GET", nil, 503, 1},
+		{"post", "POST", &retryPolicy{MaxAttempts: 3, RetryOn: []string{retryOn5xx}}, 503, 1},
+		{"post of non idempotent policy", "POST", &retryPolicy{MaxAttempts: 3, RetryOn: []string{retryOn5xx}, RetryNonIdempotent: true}, 200, 3},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&hits, 0)
+		_config = newConfiguration()
+		setupTestRoutes(t, []*service{
+			{ID: "s1", Name: "users", Upstreams: []*upstream{{Name: "u1", TargetURL: server.URL}}},
+		}, []*api{
+			{Name: "users", RequestHost: "*", RequestPath: "/", Service: "users", Retry: tt.retry},
+		})
+		gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+
+		req, _ := http.NewRequest(tt.method, gateway.URL+"/users", strings.NewReader("hello"))
+		req.Header.Set("Idempotency-Key", "k1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := atomic.LoadInt32(&hits); resp.StatusCode != tt.wantStatus || got != tt.wantHits {
+			t.Errorf("%s: got %d after %d tries, want %d after %d", tt.name, resp.StatusCode, got, tt.wantStatus, tt.wantHits)
+		}
+		if tt.wantStatus == 200 && string(body) != "hello" {
+			t.Errorf("%s: upstream got body %q, want hello", tt.name, body)
+		}
+	}
+}
+
+func TestProxyRetryStopsWhenClientIsGone(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	_config = newConfiguration()
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "users", Upstreams: []*upstream{{Name: "u1", TargetURL: server.URL}}},
+	}, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/", Service: "users",
+			Retry: &retryPolicy{MaxAttempts: 5, RetryOn: []string{retryOn5xx}, Backoff: 200}},
+	})
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", gateway.URL+"/users", nil)
+	if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		resp.Body.Close()
+		t.Fatal("the request must be canceled")
+	}
+	// the second try would start after the backoff of 200ms
+	time.Sleep(time.Second)
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("upstream got %d tries, want 1", got)
+	}
+}
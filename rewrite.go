@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// urlRewrite changes the url which is sent to upstream.  Path rules are applied in the order prefix, regex;
+// e.g. request_path "/v2/orders/*" with prefix "/internal/orders-svc/api" sends /v2/orders/1 to
+// /internal/orders-svc/api/1.
+type urlRewrite struct {
+	// Prefix replaces the matched part of request path, {name} is replaced with captured path parameter.
+	Prefix string `json:"prefix,omitempty" bson:"prefix,omitempty"`
+	// Regex is applied to the path and the match is replaced with Replacement, which may refer to
+	// capture groups with $1 or ${name}.
+	Regex       string            `json:"regex,omitempty" bson:"regex,omitempty"`
+	Replacement string            `json:"replacement,omitempty" bson:"replacement,omitempty"`
+	AddQuery    map[string]string `json:"add_query,omitempty" bson:"add_query,omitempty"`
+	RemoveQuery []string          `json:"remove_query,omitempty" bson:"remove_query,omitempty"`
+	// Host overrides the Host header which is sent to upstream.
+	Host  string `json:"host,omitempty" bson:"host,omitempty"`
+	regex *regexp.Regexp
+}
+
+func (r *urlRewrite) isValid() error {
+	if len(r.Prefix) > 0 && !strings.HasPrefix(r.Prefix, "/") {
+		return AppError{ErrorCode: "invalid_input", Message: "prefix of rewrite must start with /"}
+	}
+	if len(r.Regex) > 0 {
+		regex, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "regex of rewrite is invalid: " + err.Error()}
+		}
+		r.regex = regex
+	} else if len(r.Replacement) > 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "replacement of rewrite requires regex"}
+	}
+	for _, name := range r.RemoveQuery {
+		if len(name) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "remove_query of rewrite can't contain empty name"}
+		}
+	}
+	for name := range r.AddQuery {
+		if len(name) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "add_query of rewrite can't contain empty name"}
+		}
+	}
+	return nil
+}
+
+// rewritePath returns the upstream path.  path is the request path after upstream_path and strip_request_path
+// were applied, requestPath is the original one.
+func (r *urlRewrite) rewritePath(route *routeMatch, path string, requestPath string) string {
+	if len(r.Prefix) > 0 && len(route.api.UpstreamPath) == 0 {
+		path = expandPath(r.Prefix, route.params) + requestPath[len(route.prefix):]
+	}
+	if r.regex != nil {
+		path = r.regex.ReplaceAllString(path, r.Replacement)
+	}
+	return path
+}
+
+func (r *urlRewrite) rewriteQuery(route *routeMatch, rawQuery string) string {
+	if len(r.AddQuery) == 0 && len(r.RemoveQuery) == 0 {
+		return rawQuery
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// keep the query which can't be parsed
+		return rawQuery
+	}
+	for _, name := range r.RemoveQuery {
+		query.Del(name)
+	}
+	for name, value := range r.AddQuery {
+		query.Set(name, expandPath(value, route.params))
+	}
+	return query.Encode()
+}
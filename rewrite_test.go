@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestURLRewriteIsValid(t *testing.T) {
+	tests := []struct {
+		rewrite urlRewrite
+		wantErr bool
+	}{
+		{urlRewrite{Prefix: "/internal/{id}"}, false},
+		{urlRewrite{Regex: `^/legacy/(\w+)$`, Replacement: "/v1/$1"}, false},
+		{urlRewrite{Prefix: "internal"}, true},
+		{urlRewrite{Regex: `^/legacy/(\w+$`}, true},
+		{urlRewrite{Replacement: "/v1/$1"}, true},
+		{urlRewrite{RemoveQuery: []string{""}}, true},
+		{urlRewrite{AddQuery: map[string]string{"": "1"}}, true},
+	}
+	for _, tt := range tests {
+		rewrite := tt.rewrite
+		if err := rewrite.isValid(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, wantErr %v", tt.rewrite, err, tt.wantErr)
+		}
+	}
+}
+
+func TestURLRewrite(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.RequestURI())
+	}))
+	defer echo.Close()
+
+	_config = newConfiguration()
+	apis := []*api{
+		{Name: "orders", RequestHost: "*", RequestPath: "/v2/orders/*", Service: "echo",
+			Rewrite: &urlRewrite{Prefix: "/internal/orders-svc/api"}},
+		{Name: "accounts", RequestHost: "*", RequestPath: "/accounts/:id/*", Service: "echo",
+			Rewrite: &urlRewrite{Prefix: "/users/{id}/accounts"}},
+		{Name: "legacy", RequestHost: "*", RequestPath: "/legacy", Service: "echo",
+			Rewrite: &urlRewrite{Regex: `^/legacy/(\w+)$`, Replacement: "/v1/$1"}},
+		{Name: "search", RequestHost: "*", RequestPath: "/search/:index", Service: "echo",
+			Rewrite: &urlRewrite{AddQuery: map[string]string{"index": "{index}"}, RemoveQuery: []string{"debug"}}},
+		{Name: "hosts", RequestHost: "*", RequestPath: "/hosts", Service: "echo",
+			Rewrite: &urlRewrite{Host: "internal.example.com"}},
+	}
+	for _, apiEntry := range apis {
+		if err := apiEntry.Rewrite.isValid(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "echo", Upstreams: []*upstream{{Name: "u1", TargetURL: echo.URL}}},
+	}, apis)
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+	host := echo.URL[len("http://"):]
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v2/orders/1", host + " /internal/orders-svc/api/1"},
+		{"/accounts/7/history", host + " /users/7/accounts/history"},
+		{"/legacy/users", host + " /v1/users"},
+		// the path which doesn't match the regex is kept
+		{"/legacy/users/1", host + " /legacy/users/1"},
+		{"/search/books?q=go&debug=1", host + " /search/books?index=books&q=go"},
+		{"/hosts?q=1", "internal.example.com /hosts?q=1"},
+	}
+	for _, tt := range tests {
+		status, body := getBody(t, gateway.URL+tt.path)
+		if status != 200 || body != tt.want {
+			t.Errorf("%s: got %d %q, want %q", tt.path, status, body, tt.want)
+		}
+	}
+}
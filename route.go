@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// routeMatch is the result of matching a request against api entries.
+type routeMatch struct {
+	api    *api
+	params map[string]string
+	// prefix is the part of request path which was matched, strip_request_path removes it.
+	prefix string
+}
+
+// pathMatcher matches request path in one of three ways:
+//
+//	prefix:   /users                  the original behaviour, request path starts with it (case insensitive)
+//	template: /users/:id/orders/*rest  segments which start with ":" or "*" are captured as parameters
+//	regex:    ~^/users/(?P<id>\d+)$    named groups are captured as parameters
+type pathMatcher struct {
+	prefix   string
+	segments []string
+	regex    *regexp.Regexp
+}
+
+func isTemplatePath(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func newPathMatcher(path string) (*pathMatcher, error) {
+	if strings.HasPrefix(path, "~") {
+		regex, err := regexp.Compile(path[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &pathMatcher{regex: regex}, nil
+	}
+	if path != "*" && isTemplatePath(path) {
+		segments := strings.Split(strings.Trim(path, "/"), "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, "*") && i != len(segments)-1 {
+				return nil, AppError{ErrorCode: "invalid_input", Message: "wildcard must be the last segment of request_path"}
+			}
+			if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+				segments[i] = strings.ToLower(segment)
+			}
+		}
+		return &pathMatcher{segments: segments}, nil
+	}
+	return &pathMatcher{prefix: strings.ToLower(path)}, nil
+}
+
+// match returns the captured parameters and the matched part of path when the path matches.
+func (m *pathMatcher) match(path string) (bool, map[string]string, string) {
+	if m.regex != nil {
+		loc := m.regex.FindStringSubmatchIndex(path)
+		if loc == nil {
+			return false, nil, ""
+		}
+		params := map[string]string{}
+		for i, name := range m.regex.SubexpNames() {
+			if len(name) > 0 && loc[2*i] >= 0 {
+				params[name] = path[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		return true, params, path[:loc[1]]
+	}
+
+	if m.segments != nil {
+		return m.matchTemplate(path)
+	}
+
+	if m.prefix == "*" {
+		return true, nil, ""
+	}
+	if strings.HasPrefix(strings.ToLower(path), m.prefix) == false {
+		return false, nil, ""
+	}
+	return true, nil, path[:len(m.prefix)]
+}
+
+func (m *pathMatcher) matchTemplate(path string) (bool, map[string]string, string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	params := map[string]string{}
+	matched := 0 // length of matched path, every segment is counted with its leading slash
+
+	for i, segment := range m.segments {
+		if strings.HasPrefix(segment, "*") {
+			rest := ""
+			if i < len(parts) {
+				rest = strings.Join(parts[i:], "/")
+			}
+			name := segment[1:]
+			if len(name) == 0 {
+				name = "*"
+			}
+			params[name] = rest
+			return true, params, path[:matched]
+		}
+		if i >= len(parts) || len(parts[i]) == 0 {
+			return false, nil, ""
+		}
+		if strings.HasPrefix(segment, ":") {
+			params[segment[1:]] = parts[i]
+		} else if segment != strings.ToLower(parts[i]) {
+			return false, nil, ""
+		}
+		matched += len(parts[i]) + 1
+	}
+	if len(parts) != len(m.segments) {
+		return false, nil, ""
+	}
+	return true, params, path
+}
+
+// expandPath replaces {name} in the template with captured parameters.
+func expandPath(template string, params map[string]string) string {
+	if len(params) == 0 || !strings.Contains(template, "{") {
+		return template
+	}
+	pairs := []string{}
+	for name, value := range params {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// matchAPI returns the first api entry which matches the request method, host and path.
+func matchAPI(req *http.Request) *routeMatch {
+	return currentRoutes().match(req)
+}
+
+// matchedRoute returns the route of the request, the result is kept in the context so
+// middlewares don't need to match again.
+func matchedRoute(c *napnap.Context) *routeMatch {
+	if val, ok := c.Get("route"); ok {
+		route, _ := val.(*routeMatch)
+		return route
+	}
+	route := matchAPI(c.Request)
+	c.Set("route", route)
+	return route
+}
+
+// matchedAPI returns the api entry of the request.
+func matchedAPI(c *napnap.Context) *api {
+	route := matchedRoute(c)
+	if route == nil {
+		return nil
+	}
+	return route.api
+}
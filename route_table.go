@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// _routes holds the current *routeTable.  The table is rebuilt whenever apis or services are reloaded and
+// swapped atomically, so the proxy never locks while it routes requests.  The table is the only owner of the
+// api entries and services, admin api reads them from the table as well.
+var _routes atomic.Value
+
+// _routesMutex serializes the writers of route table, so reloads don't overwrite each other.
+var _routesMutex sync.Mutex
+
+type routeEntry struct {
+	api     *api
+	matcher *pathMatcher
+	order   int // position in apis, the smaller one wins when several entries match
+}
+
+type routeTable struct {
+	apis        []*api                // all api entries in the order of repository, including the invalid ones
+	serviceList []*service            // all services in the order of repository
+	hosts       map[string]*radixNode // lower case host -> paths
+	anyHost     *radixNode            // apis with "*" request host
+	services    map[string]*service   // service name -> service
+}
+
+func newRouteTable(apis []*api, services []*service) *routeTable {
+	table := &routeTable{
+		apis:        apis,
+		serviceList: services,
+		hosts:       map[string]*radixNode{},
+		anyHost:     &radixNode{},
+		services:    map[string]*service{},
+	}
+
+	for i, apiElement := range apis {
+		// the api entries which were loaded from database are validated, which compiles their rules as well
+		err := apiElement.isValid()
+		if err != nil {
+			_logger.errorf("api is invalid: %s: %v", apiElement.Name, err)
+			continue
+		}
+		matcher, _ := newPathMatcher(apiElement.RequestPath) // request path was checked by isValid
+		entry := &routeEntry{
+			api:     apiElement,
+			matcher: matcher,
+			order:   i,
+		}
+
+		tree := table.anyHost
+		if apiElement.RequestHost != "*" {
+			host := strings.ToLower(apiElement.RequestHost)
+			tree = table.hosts[host]
+			if tree == nil {
+				tree = &radixNode{}
+				table.hosts[host] = tree
+			}
+		}
+		tree.insert(matcher.staticPrefix(), entry)
+	}
+
+	for _, svc := range services {
+		table.services[svc.Name] = svc
+	}
+	return table
+}
+
+// setAPIs replaces the api entries and rebuilds the route table.  The api entries must be new instances, e.g.
+// loaded from repository, because they are validated while the old ones may be serving requests.
+func setAPIs(apis []*api) {
+	_routesMutex.Lock()
+	defer _routesMutex.Unlock()
+	_routes.Store(newRouteTable(apis, currentRoutes().serviceList))
+}
+
+// setServices replaces the services and keeps the routes of api entries.  Upstreams, circuit state and
+// health check schedule of the existing services are carried over, because they are registered and learned
+// at runtime.
+func setServices(services []*service) {
+	_routesMutex.Lock()
+	defer _routesMutex.Unlock()
+
+	old := currentRoutes()
+	for _, newSvc := range services {
+		for _, oldSvc := range old.serviceList {
+			if newSvc.ID == oldSvc.ID && newSvc != oldSvc {
+				newSvc.takeStateFrom(oldSvc)
+			}
+		}
+	}
+	table := &routeTable{
+		apis:        old.apis,
+		serviceList: services,
+		hosts:       old.hosts,
+		anyHost:     old.anyHost,
+		services:    map[string]*service{},
+	}
+	for _, svc := range services {
+		table.services[svc.Name] = svc
+	}
+	_routes.Store(table)
+}
+
+func currentRoutes() *routeTable {
+	table, _ := _routes.Load().(*routeTable)
+	if table == nil {
+		return newRouteTable(nil, nil)
+	}
+	return table
+}
+
+func (t *routeTable) match(req *http.Request) *routeMatch {
+	path := req.URL.Path
+	lowerPath := strings.ToLower(path)
+
+	var result *routeMatch
+	order := -1
+	try := func(entry *routeEntry) {
+		if order >= 0 && entry.order > order {
+			return
+		}
+		// ensure request method is match
+		if len(entry.api.Methods) > 0 && !contains(entry.api.Methods, req.Method) {
+			return
+		}
+		// ensure request path is match
+		ok, params, prefix := entry.matcher.match(path)
+		if !ok {
+			return
+		}
+		order = entry.order
+		result = &routeMatch{
+			api:    entry.api,
+			params: params,
+			prefix: prefix,
+		}
+	}
+
+	if tree := t.hosts[strings.ToLower(req.Host)]; tree != nil {
+		tree.walk(lowerPath, try)
+	}
+	t.anyHost.walk(lowerPath, try)
+	return result
+}
+
+func (t *routeTable) service(name string) *service {
+	return t.services[name]
+}
+
+// staticPrefix returns the lower case literal beginning of the request path which is used as
+// the key in radix tree.
+func (m *pathMatcher) staticPrefix() string {
+	if m.regex != nil {
+		// the regex is not anchored, it has to be tried for every path
+		return ""
+	}
+	if m.segments != nil {
+		prefix := ""
+		for _, segment := range m.segments {
+			if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+				break
+			}
+			prefix += "/" + segment
+		}
+		return prefix
+	}
+	if m.prefix == "*" {
+		return ""
+	}
+	return m.prefix
+}
+
+// radixNode is a compressed prefix tree.  A route entry is stored at the node of its static prefix,
+// so walking a request path visits every entry which may match.
+type radixNode struct {
+	label    string
+	children []*radixNode
+	entries  []*routeEntry
+}
+
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func (n *radixNode) insert(key string, entry *routeEntry) {
+	for {
+		if len(key) == 0 {
+			n.entries = append(n.entries, entry)
+			return
+		}
+
+		var next *radixNode
+		for _, child := range n.children {
+			if child.label[0] == key[0] {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			n.children = append(n.children, &radixNode{label: key, entries: []*routeEntry{entry}})
+			return
+		}
+
+		l := commonPrefixLength(key, next.label)
+		if l < len(next.label) {
+			// split the child
+			split := &radixNode{
+				label:    next.label[l:],
+				children: next.children,
+				entries:  next.entries,
+			}
+			next.label = next.label[:l]
+			next.children = []*radixNode{split}
+			next.entries = nil
+		}
+		key = key[l:]
+		n = next
+	}
+}
+
+// walk calls fn with the entries of every node whose key is a prefix of path.
+func (n *radixNode) walk(path string, fn func(entry *routeEntry)) {
+	for {
+		for _, entry := range n.entries {
+			fn(entry)
+		}
+		if len(path) == 0 {
+			return
+		}
+
+		var next *radixNode
+		for _, child := range n.children {
+			if child.label[0] == path[0] {
+				next = child
+				break
+			}
+		}
+		if next == nil || !strings.HasPrefix(path, next.label) {
+			return
+		}
+		path = path[len(next.label):]
+		n = next
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRadixTree(t *testing.T) {
+	keys := []string{"/users", "/users/orders", "/user", "/apps", "", "/users/orders", "/u"}
+	tree := &radixNode{}
+	for i, key := range keys {
+		tree.insert(key, &routeEntry{order: i})
+	}
+
+	tests := []struct {
+		path string
+		want []int
+	}{
+		{"/users/orders/1", []int{1, 2, 0, 4, 5, 6}},
+		{"/users/1", []int{0, 2, 4, 6}},
+		{"/user", []int{2, 4, 6}},
+		{"/us", []int{4, 6}},
+		{"/apps", []int{3, 4}},
+		{"/orders", []int{4}},
+		{"", []int{4}},
+	}
+	for _, tt := range tests {
+		got := []int{}
+		tree.walk(tt.path, func(entry *routeEntry) {
+			got = append(got, entry.order)
+		})
+		sort.Ints(got)
+		want := append([]int{}, tt.want...)
+		sort.Ints(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("walk(%q) = %v, want %v", tt.path, got, want)
+		}
+	}
+}
+
+func TestStaticPrefix(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"*", ""},
+		{"/Users", "/users"},
+		{"/users/:id/orders", "/users"},
+		{"/Files/*path", "/files"},
+		{"/:tenant/users", ""},
+		{`~^/users/\d+`, ""},
+	}
+	for _, tt := range tests {
+		m, err := newPathMatcher(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.staticPrefix(); got != tt.want {
+			t.Errorf("staticPrefix(%s) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	_logger = newLog()
+	apis := []*api{
+		{Name: "orders", RequestHost: "example.com", RequestPath: "/users/:id/orders"},
+		{Name: "users", RequestHost: "*", RequestPath: "/users"},
+		{Name: "admin", RequestHost: "*", RequestPath: "/admin", Methods: []string{"post"}},
+		{Name: "any", RequestHost: "Example.com", RequestPath: "*"},
+		{Name: "invalid", RequestHost: "*", RequestPath: "/files/*path/more"},
+		{Name: "regex", RequestHost: "*", RequestPath: `~^/v(?P<version>\d+)/`},
+	}
+	table := newRouteTable(apis, nil)
+
+	tests := []struct {
+		method string
+		url    string
+		want   string
+	}{
+		{"GET", "http://example.com/users/1/orders", "orders"},
+		{"GET", "http://EXAMPLE.com/users/1", "users"},
+		{"GET", "http://other.com/users/1/orders", "users"},
+		{"GET", "http://example.com/other", "any"},
+		{"POST", "http://other.com/admin", "admin"},
+		{"GET", "http://other.com/admin", ""},
+		{"GET", "http://other.com/files/a/more", ""},
+		{"GET", "http://other.com/v2/users", "regex"},
+		{"GET", "http://other.com/other", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		got := ""
+		if route := table.match(req); route != nil {
+			got = route.api.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.method, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestSetServicesTakesState(t *testing.T) {
+	ejectedUntil := time.Now().Add(time.Minute)
+	nextCheckAt := time.Now().Add(time.Hour)
+	old := &service{ID: "s1", Name: "users", Upstreams: []*upstream{
+		{Name: "u1", TargetURL: "http://10.0.0.1", State: upstreamUp, ActiveRequests: 3, TotalRequests: 10},
+		{Name: "u2", TargetURL: "http://10.0.0.2", State: upstreamDown, EjectedUntil: &ejectedUntil, Ejections: 1},
+	}, Circuit: &circuitState{State: circuitOpen}, nextCheckAt: nextCheckAt}
+	setupTestRoutes(t, []*service{old}, nil)
+
+	// requests which were sent before the reload keep using the old service
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if u := old.askForUpstream("", nil); u != nil {
+				old.reportResult(u, true)
+				old.releaseUpstream(u)
+			}
+		}
+		done <- true
+	}()
+	setServices([]*service{{ID: "s1", Name: "users"}})
+	<-done
+
+	svc := currentRoutes().service("users")
+	if svc == old || len(svc.Upstreams) != 2 {
+		t.Fatalf("got %+v, want a new service with 2 upstreams", svc)
+	}
+	for i, u := range svc.Upstreams {
+		if u == old.Upstreams[i] {
+			t.Errorf("%s is shared with the old service", u.Name)
+		}
+		if u.ActiveRequests != 0 {
+			t.Errorf("%s has %d active requests, want 0", u.Name, u.ActiveRequests)
+		}
+	}
+	u2 := svc.Upstreams[1]
+	if u2.State != upstreamDown || u2.EjectedUntil == nil || !u2.EjectedUntil.Equal(ejectedUntil) || u2.EjectedUntil == old.Upstreams[1].EjectedUntil || u2.Ejections != 1 {
+		t.Errorf("state of u2 wasn't copied: %+v", u2)
+	}
+	if svc.Circuit == nil || svc.Circuit == old.Circuit || svc.Circuit.State != circuitOpen {
+		t.Errorf("circuit wasn't copied: %+v", svc.Circuit)
+	}
+	if !svc.nextCheckAt.Equal(nextCheckAt) {
+		t.Errorf("next check at %v, want %v", svc.nextCheckAt, nextCheckAt)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPathMatcher(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		ok      bool
+		params  map[string]string
+		prefix  string
+	}{
+		// prefix
+		{"*", "/anything", true, nil, ""},
+		{"/users", "/users/1", true, nil, "/users"},
+		{"/Users", "/USERS/1", true, nil, "/USERS"},
+		{"/users", "/orders", false, nil, ""},
+		// template
+		{"/users/:id", "/users/1", true, map[string]string{"id": "1"}, "/users/1"},
+		{"/users/:id", "/Users/Ab", true, map[string]string{"id": "Ab"}, "/Users/Ab"},
+		{"/users/:id", "/users", false, nil, ""},
+		{"/users/:id", "/users/1/orders", false, nil, ""},
+		{"/users/:id", "/users//", false, nil, ""},
+		{"/users/:id/orders/:orderID", "/users/1/orders/2", true, map[string]string{"id": "1", "orderID": "2"}, "/users/1/orders/2"},
+		{"/files/*path", "/files/a/b/c.txt", true, map[string]string{"path": "a/b/c.txt"}, "/files"},
+		{"/files/*path", "/files", true, map[string]string{"path": ""}, "/files"},
+		{"/users/:id/*", "/users/1/x/y", true, map[string]string{"id": "1", "*": "x/y"}, "/users/1"},
+		// regex
+		{`~^/users/(?P<id>\d+)`, "/users/12/orders", true, map[string]string{"id": "12"}, "/users/12"},
+		{`~^/users/(?P<id>\d+)$`, "/users/ab", false, nil, ""},
+		{`~^/(?P<a>x)?y`, "/y", true, map[string]string{}, "/y"},
+	}
+	for _, tt := range tests {
+		m, err := newPathMatcher(tt.pattern)
+		if err != nil {
+			t.Errorf("%s: %v", tt.pattern, err)
+			continue
+		}
+		ok, params, prefix := m.match(tt.path)
+		if ok != tt.ok || !reflect.DeepEqual(params, tt.params) || prefix != tt.prefix {
+			t.Errorf("%s matches %s: got (%v, %v, %q), want (%v, %v, %q)", tt.pattern, tt.path, ok, params, prefix, tt.ok, tt.params, tt.prefix)
+		}
+	}
+}
+
+func TestNewPathMatcherError(t *testing.T) {
+	tests := []string{
+		"/files/*path/more",
+		"~^/users/(",
+	}
+	for _, pattern := range tests {
+		if _, err := newPathMatcher(pattern); err == nil {
+			t.Errorf("%s: expected error", pattern)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	tests := []struct {
+		template string
+		params   map[string]string
+		want     string
+	}{
+		{"/v2/users/{id}", map[string]string{"id": "1"}, "/v2/users/1"},
+		{"/v2/{a}/{b}/{a}", map[string]string{"a": "x", "b": "y"}, "/v2/x/y/x"},
+		{"/v2/users/{id}", nil, "/v2/users/{id}"},
+		{"/v2/users", map[string]string{"id": "1"}, "/v2/users"},
+	}
+	for _, tt := range tests {
+		if got := expandPath(tt.template, tt.params); got != tt.want {
+			t.Errorf("expandPath(%s, %v) = %s, want %s", tt.template, tt.params, got, tt.want)
+		}
+	}
+}
@@ -12,22 +12,169 @@ import (
 )
 
 type upstream struct {
-	count         int       `json:"-" bson:"-"`
-	Name          string    `json:"name" bson:"-"`
-	TargetURL     string    `json:"target_url" bson:"-"`
-	TotalRequests uint64    `json:"total_requests" bson:"-"`
-	UpdatedAt     time.Time `json:"updated_at" bson:"-"`
-	State         string    `json:"state" bson:"-"`
+	count          int        `json:"-" bson:"-"`
+	currentWeight  int        `json:"-" bson:"-"`
+	successes      int        `json:"-" bson:"-"`
+	failures       int        `json:"-" bson:"-"`
+	Name           string     `json:"name" bson:"-"`
+	TargetURL      string     `json:"target_url" bson:"-"`
+	Weight         int        `json:"weight" bson:"-"`
+	ActiveRequests int64      `json:"active_requests" bson:"-"`
+	TotalRequests  uint64     `json:"total_requests" bson:"-"`
+	UpdatedAt      time.Time  `json:"updated_at" bson:"-"`
+	State          string     `json:"state" bson:"-"`
+	EjectedUntil   *time.Time `json:"ejected_until,omitempty" bson:"-"`
+	Ejections      int        `json:"ejections" bson:"-"`
+
+	consecutiveErrors int
+	windowStart       time.Time
+	windowRequests    int
+	windowErrors      int
 }
 
 type service struct {
-	sync.RWMutex `json:"-" bson:"-"`
-	ID           string      `json:"id" bson:"_id"`
-	Name         string      `json:"name" `
-	Port         int         `json:"port" `
-	Upstreams    []*upstream `json:"upstreams"`
-	CreatedAt    time.Time   `json:"created_at" bson:"created_at"`
-	UpdatedAt    time.Time   `json:"updated_at" bson:"updated_at"`
+	sync.RWMutex     `json:"-" bson:"-"`
+	ID               string            `json:"id" bson:"_id"`
+	Name             string            `json:"name" `
+	Port             int               `json:"port" `
+	Upstreams        []*upstream       `json:"upstreams"`
+	LoadBalancer     string            `json:"load_balancer" bson:"load_balancer"`
+	HashOn           string            `json:"hash_on,omitempty" bson:"hash_on,omitempty"`
+	HashHeader       string            `json:"hash_header,omitempty" bson:"hash_header,omitempty"`
+	HealthCheck      *healthCheck      `json:"health_check,omitempty" bson:"health_check,omitempty"`
+	OutlierDetection *outlierDetection `json:"outlier_detection,omitempty" bson:"outlier_detection,omitempty"`
+	CircuitBreaker   *circuitBreaker   `json:"circuit_breaker,omitempty" bson:"circuit_breaker,omitempty"`
+	Timeouts         *TimeoutSetting   `json:"timeouts,omitempty" bson:"timeouts,omitempty"`
+	Protocol         string            `json:"protocol,omitempty" bson:"protocol,omitempty"`
+	Circuit          *circuitState     `json:"circuit,omitempty" bson:"-"`
+	CreatedAt        time.Time         `json:"created_at" bson:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at" bson:"updated_at"`
+	balancer         balancer
+	checking         bool
+	nextCheckAt      time.Time
+}
+
+func (u *upstream) isAvailable() bool {
+	if u.State == upstreamDown {
+		return false
+	}
+	return u.EjectedUntil == nil || time.Now().After(*u.EjectedUntil)
+}
+
+func (u *upstream) weight() int {
+	if u.Weight <= 0 {
+		return 1
+	}
+	return u.Weight
+}
+
+func (s *service) isValid() error {
+	if len(s.Name) == 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "name field can't be empty or null"}
+	}
+	if !isValidBalancer(s.LoadBalancer) {
+		return AppError{ErrorCode: "invalid_input", Message: "load_balancer field is invalid"}
+	}
+	if !isValidProtocol(s.Protocol) {
+		return AppError{ErrorCode: "invalid_input", Message: "protocol field must be http1, h2 or h2c"}
+	}
+	if s.LoadBalancer == consistentHash {
+		switch s.HashOn {
+		case hashOnHeader:
+			if len(s.HashHeader) == 0 {
+				return AppError{ErrorCode: "invalid_input", Message: "hash_header field can't be empty when hash_on is header"}
+			}
+		case "", hashOnConsumer, hashOnIP:
+		default:
+			return AppError{ErrorCode: "invalid_input", Message: "hash_on field is invalid"}
+		}
+	}
+	if s.HealthCheck != nil {
+		err := s.HealthCheck.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if s.OutlierDetection != nil {
+		err := s.OutlierDetection.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if s.CircuitBreaker != nil {
+		err := s.CircuitBreaker.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	if s.Timeouts != nil {
+		err := s.Timeouts.isValid()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot returns a copy of the service for admin api, the counters and states are updated by requests
+// and health checks, so they must be copied under the lock before they are encoded.
+func (s *service) snapshot() *service {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := &service{
+		ID:               s.ID,
+		Name:             s.Name,
+		Port:             s.Port,
+		Upstreams:        make([]*upstream, 0, len(s.Upstreams)),
+		LoadBalancer:     s.LoadBalancer,
+		HashOn:           s.HashOn,
+		HashHeader:       s.HashHeader,
+		HealthCheck:      s.HealthCheck,
+		OutlierDetection: s.OutlierDetection,
+		CircuitBreaker:   s.CircuitBreaker,
+		Timeouts:         s.Timeouts,
+		Protocol:         s.Protocol,
+		CreatedAt:        s.CreatedAt,
+		UpdatedAt:        s.UpdatedAt,
+	}
+	for _, u := range s.Upstreams {
+		copied := *u
+		if u.EjectedUntil != nil {
+			ejectedUntil := *u.EjectedUntil
+			copied.EjectedUntil = &ejectedUntil
+		}
+		result.Upstreams = append(result.Upstreams, &copied)
+	}
+	if s.Circuit != nil {
+		circuit := *s.Circuit
+		if s.Circuit.OpenedAt != nil {
+			openedAt := *s.Circuit.OpenedAt
+			circuit.OpenedAt = &openedAt
+		}
+		result.Circuit = &circuit
+	}
+	return result
+}
+
+// takeStateFrom carries the runtime state of the replaced service over.  The state is copied into new structs,
+// because the requests and health checks which are still running against the old service keep updating the
+// old upstreams under the old lock.  Those requests release the old upstreams, so active requests start from
+// zero.
+func (s *service) takeStateFrom(old *service) {
+	state := old.snapshot()
+	for _, u := range state.Upstreams {
+		u.ActiveRequests = 0
+	}
+	old.RLock()
+	nextCheckAt := old.nextCheckAt
+	old.RUnlock()
+
+	s.Lock()
+	defer s.Unlock()
+	s.Upstreams = state.Upstreams
+	s.Circuit = state.Circuit
+	s.nextCheckAt = nextCheckAt
 }
 
 func newServiceCollection() *serviceCollection {
@@ -46,12 +193,14 @@ func (s *service) registerUpstream(source *upstream) {
 		if u.Name == source.Name {
 			u.UpdatedAt = time.Now().UTC()
 			u.TargetURL = source.TargetURL
+			u.Weight = source.Weight
 			return
 		}
 	}
 
 	// add upstream
 	source.UpdatedAt = time.Now().UTC()
+	source.State = upstreamUp
 	s.Upstreams = append(s.Upstreams, source)
 }
 
@@ -68,42 +217,65 @@ func (s *service) unregisterUpstream(source *upstream) {
 	}
 }
 
-func (s *service) askForUpstream() *upstream {
+func (s *service) setUpstreamState(source *upstream, state string) {
 	s.Lock()
 	defer s.Unlock()
 
-	var result *upstream
-	if len(s.Upstreams) == 1 {
-		result = s.Upstreams[0]
-		result.TotalRequests++
-		return result
-	}
+	source.successes = 0
+	source.failures = 0
+	source.State = state
+	source.UpdatedAt = time.Now().UTC()
+}
 
+// askForUpstream picks an available upstream.  The upstreams which were tried already are skipped
+// unless there isn't any other choice.
+func (s *service) askForUpstream(key string, tried []*upstream) *upstream {
+	s.Lock()
+	defer s.Unlock()
+
+	// skip unhealthy upstreams
+	upstreams := []*upstream{}
+	untried := []*upstream{}
 	for _, u := range s.Upstreams {
-		if u.count == 0 {
-			u.TotalRequests++
-			u.count++
-			result = u
-			break
-		}
-	}
-	// reset count
-	if result == nil {
-		for _, u := range s.Upstreams {
-			u.count = 0
-		}
-		for _, u := range s.Upstreams {
-			if u.count == 0 {
-				u.TotalRequests++
-				u.count++
-				result = u
-				break
+		if u.isAvailable() {
+			upstreams = append(upstreams, u)
+			if !containsUpstream(tried, u) {
+				untried = append(untried, u)
 			}
 		}
 	}
+	if len(upstreams) == 0 {
+		return nil
+	}
+	if len(untried) > 0 {
+		upstreams = untried
+	}
+
+	if s.balancer == nil {
+		s.balancer = newBalancer(s.LoadBalancer)
+	}
+	result := s.balancer.pick(upstreams, key)
+	result.TotalRequests++
+	result.ActiveRequests++
 	return result
 }
 
+func containsUpstream(upstreams []*upstream, target *upstream) bool {
+	for _, u := range upstreams {
+		if u == target {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseUpstream must be called when the request which askForUpstream was made for is completed.
+func (s *service) releaseUpstream(source *upstream) {
+	s.Lock()
+	defer s.Unlock()
+	source.ActiveRequests--
+}
+
 type serviceCollection struct {
 	Count    int        `json:"count"`
 	Services []*service `json:"services"`
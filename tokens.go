@@ -25,14 +25,28 @@ func newTokenCollection() *tokenCollection {
 }
 
 type Token struct {
-	ID         string    `json:"id" bson:"_id"`
-	Source     string    `json:"source" bson:"source"`
-	ConsumerID string    `json:"consumer_id" bson:"consumer_id"`
-	IPAddress  string    `json:"ip_address" bson:"ip_address"`
-	ExpiresIn  int64     `json:"expires_in" bson:"-"`
-	Expiration time.Time `json:"expiration" bson:"expiration"`
-	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
-}
+	ID         string `json:"id" bson:"_id"`
+	Source     string `json:"source" bson:"source"`
+	ConsumerID string `json:"consumer_id" bson:"consumer_id"`
+	IPAddress  string `json:"ip_address" bson:"ip_address"`
+	ExpiresIn  int64  `json:"expires_in" bson:"-"`
+	// Type is empty for access token and refresh for oauth2 refresh token.
+	Type   string   `json:"type,omitempty" bson:"type,omitempty"`
+	Scopes []string `json:"scopes,omitempty" bson:"scopes,omitempty"`
+	// Format is opaque (default), jwt or both, it is only used when creating the token.
+	Format      string    `json:"format,omitempty" bson:"-"`
+	AccessToken string    `json:"access_token,omitempty" bson:"-"`
+	Expiration  time.Time `json:"expiration" bson:"expiration"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+}
+
+const (
+	tokenTypeRefresh = "refresh"
+
+	tokenFormatOpaque = "opaque"
+	tokenFormatJWT    = "jwt"
+	tokenFormatBoth   = "both"
+)
 
 func newToken(consumerID string) *Token {
 	now := time.Now().UTC()
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+)
+
+// trafficSplit sends the requests of an api entry to several services by percentage, e.g. 90% to the stable
+// service and 10% to the canary.  Overrides are checked first, so testers can always hit the canary.
+type trafficSplit struct {
+	Services  []*splitService  `json:"services" bson:"services"`
+	Overrides []*splitOverride `json:"overrides,omitempty" bson:"overrides,omitempty"`
+	// Sticky keeps a consumer, or a client ip for anonymous requests, on the same service while the weights don't change.
+	Sticky bool `json:"sticky" bson:"sticky"`
+}
+
+type splitService struct {
+	Service string `json:"service" bson:"service"`
+	Weight  int    `json:"weight" bson:"weight"` // percentage
+}
+
+// splitOverride matches when every condition which is set matches, empty Value matches any value of the header or cookie.
+type splitOverride struct {
+	Header  string `json:"header,omitempty" bson:"header,omitempty"`
+	Cookie  string `json:"cookie,omitempty" bson:"cookie,omitempty"`
+	Value   string `json:"value,omitempty" bson:"value,omitempty"`
+	Role    string `json:"role,omitempty" bson:"role,omitempty"`
+	Service string `json:"service" bson:"service"`
+}
+
+func (ts *trafficSplit) isValid() error {
+	if len(ts.Services) == 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "services of traffic_split can't be empty"}
+	}
+	total := 0
+	for _, s := range ts.Services {
+		if len(s.Service) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "service of traffic_split can't be empty"}
+		}
+		if s.Weight < 0 || s.Weight > 100 {
+			return AppError{ErrorCode: "invalid_input", Message: "weight of traffic_split must be between 0 and 100"}
+		}
+		total += s.Weight
+	}
+	if total != 100 {
+		return AppError{ErrorCode: "invalid_input", Message: "weights of traffic_split must add up to 100"}
+	}
+	for _, o := range ts.Overrides {
+		if len(o.Service) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "service of traffic_split override can't be empty"}
+		}
+		if len(o.Header) == 0 && len(o.Cookie) == 0 && len(o.Role) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "traffic_split override requires header, cookie or role"}
+		}
+		if len(o.Header) > 0 && len(o.Cookie) > 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "traffic_split override can't have both header and cookie"}
+		}
+	}
+	return nil
+}
+
+// checkServices returns an error when a service of the split doesn't exist.  It is only checked when the split is
+// saved by admin api, services may be deleted later and the api entry must keep serving the other services.
+func (ts *trafficSplit) checkServices(table *routeTable) error {
+	for _, s := range ts.Services {
+		if table.service(s.Service) == nil {
+			return AppError{ErrorCode: "invalid_input", Message: "service of traffic_split was not found: " + s.Service}
+		}
+	}
+	for _, o := range ts.Overrides {
+		if table.service(o.Service) == nil {
+			return AppError{ErrorCode: "invalid_input", Message: "service of traffic_split override was not found: " + o.Service}
+		}
+	}
+	return nil
+}
+
+func (o *splitOverride) isMatch(req *http.Request, consumer Consumer) bool {
+	if len(o.Header) > 0 {
+		values, ok := req.Header[http.CanonicalHeaderKey(o.Header)]
+		if !ok || (len(o.Value) > 0 && !contains(values, o.Value)) {
+			return false
+		}
+	}
+	if len(o.Cookie) > 0 {
+		cookie, err := req.Cookie(o.Cookie)
+		if err != nil || (len(o.Value) > 0 && cookie.Value != o.Value) {
+			return false
+		}
+	}
+	if len(o.Role) > 0 && !contains(consumer.Roles, o.Role) {
+		return false
+	}
+	return true
+}
+
+// pick returns the service name of the request.
+func (ts *trafficSplit) pick(req *http.Request, consumer Consumer, clientIP string) string {
+	for _, o := range ts.Overrides {
+		if o.isMatch(req, consumer) {
+			return o.Service
+		}
+	}
+
+	var point int
+	if ts.Sticky {
+		key := clientIP
+		if consumer.isAuthenticated() {
+			key = consumer.ID
+		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		point = int(h.Sum32() % 100)
+	} else {
+		point = rand.Intn(100)
+	}
+	for _, s := range ts.Services {
+		if point < s.Weight {
+			return s.Service
+		}
+		point -= s.Weight
+	}
+	return ts.Services[len(ts.Services)-1].Service
+}
+
+// serviceName returns the service which serves the request, traffic split wins over service field.  The service
+// field is used when the picked service was deleted.
+func (a *api) serviceName(req *http.Request, consumer Consumer) string {
+	if a.TrafficSplit == nil || len(a.TrafficSplit.Services) == 0 {
+		return a.Service
+	}
+	name := a.TrafficSplit.pick(req, consumer, getClientIP(req))
+	if currentRoutes().service(name) == nil {
+		_logger.debugf("service of traffic_split was not found: %s", name)
+		return a.Service
+	}
+	return name
+}
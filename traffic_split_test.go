@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrafficSplitIsValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		split   trafficSplit
+		wantErr bool
+	}{
+		{"valid", trafficSplit{Services: []*splitService{{"stable", 90}, {"canary", 10}}}, false},
+		{"zero weight", trafficSplit{Services: []*splitService{{"stable", 100}, {"canary", 0}}}, false},
+		{"override", trafficSplit{Services: []*splitService{{"stable", 100}}, Overrides: []*splitOverride{{Header: "X-Canary", Service: "canary"}}}, false},
+		{"empty", trafficSplit{}, true},
+		{"empty service", trafficSplit{Services: []*splitService{{"", 100}}}, true},
+		{"negative weight", trafficSplit{Services: []*splitService{{"stable", 110}, {"canary", -10}}}, true},
+		{"sum", trafficSplit{Services: []*splitService{{"stable", 90}, {"canary", 20}}}, true},
+		{"override without condition", trafficSplit{Services: []*splitService{{"stable", 100}}, Overrides: []*splitOverride{{Service: "canary"}}}, true},
+		{"override with header and cookie", trafficSplit{Services: []*splitService{{"stable", 100}}, Overrides: []*splitOverride{{Header: "X-Canary", Cookie: "canary", Service: "canary"}}}, true},
+		{"override without service", trafficSplit{Services: []*splitService{{"stable", 100}}, Overrides: []*splitOverride{{Header: "X-Canary"}}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.split.isValid(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTrafficSplitCheckServices(t *testing.T) {
+	table := newRouteTable(nil, []*service{{Name: "stable"}, {Name: "canary"}})
+	tests := []struct {
+		name    string
+		split   trafficSplit
+		wantErr bool
+	}{
+		{"services", trafficSplit{Services: []*splitService{{"stable", 90}, {"canary", 10}}}, false},
+		{"unknown service", trafficSplit{Services: []*splitService{{"stable", 50}, {"other", 50}}}, true},
+		{"override", trafficSplit{Services: []*splitService{{"stable", 100}}, Overrides: []*splitOverride{{Header: "X-Canary", Service: "canary"}}}, false},
+		{"override of unknown service", trafficSplit{Services: []*splitService{{"stable", 100}}, Overrides: []*splitOverride{{Header: "X-Canary", Service: "other"}}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.split.checkServices(table); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTrafficSplitDeletedService(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	stable := newUpstream("stable")
+	canary := newUpstream("canary")
+
+	_config = newConfiguration()
+	split := &trafficSplit{
+		Services:  []*splitService{{"stable", 50}, {"canary", 50}},
+		Overrides: []*splitOverride{{Header: "X-Canary", Service: "canary"}},
+	}
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "stable", Upstreams: []*upstream{{Name: "u1", TargetURL: stable.URL}}},
+		{ID: "s2", Name: "canary", Upstreams: []*upstream{{Name: "u2", TargetURL: canary.URL}}},
+	}, []*api{
+		{Name: "users", RequestHost: "*", RequestPath: "/", Service: "stable", TrafficSplit: split},
+	})
+	gateway := newTestGateway(t, Consumer{}, newProxy().Invoke)
+
+	get := func(canary bool) (int, string) {
+		req, _ := http.NewRequest("GET", gateway.URL+"/users", nil)
+		if canary {
+			req.Header.Set("X-Canary", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, body := get(true); status != 200 || body != "canary" {
+		t.Fatalf("got %d %q, want 200 canary", status, body)
+	}
+
+	// the canary is deleted, the api entry is still routed and falls back to its service
+	setServices([]*service{{ID: "s1", Name: "stable", Upstreams: []*upstream{{Name: "u1", TargetURL: stable.URL}}}})
+	setAPIs(currentRoutes().apis)
+	for _, canary := range []bool{true, false, false, false} {
+		if status, body := get(canary); status != 200 || body != "stable" {
+			t.Fatalf("canary header %v: got %d %q, want 200 stable", canary, status, body)
+		}
+	}
+}
+
+func TestSplitOverrideIsMatch(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Canary", "yes")
+	req.AddCookie(&http.Cookie{Name: "beta", Value: "1"})
+	consumer := Consumer{ID: "c1", Roles: []string{"tester"}}
+
+	tests := []struct {
+		override splitOverride
+		want     bool
+	}{
+		{splitOverride{Header: "x-canary"}, true},
+		{splitOverride{Header: "X-Canary", Value: "yes"}, true},
+		{splitOverride{Header: "X-Canary", Value: "no"}, false},
+		{splitOverride{Header: "X-Other"}, false},
+		{splitOverride{Cookie: "beta"}, true},
+		{splitOverride{Cookie: "beta", Value: "1"}, true},
+		{splitOverride{Cookie: "beta", Value: "2"}, false},
+		{splitOverride{Cookie: "other"}, false},
+		{splitOverride{Role: "tester"}, true},
+		{splitOverride{Role: "admin"}, false},
+		{splitOverride{Header: "X-Canary", Role: "admin"}, false},
+		{splitOverride{Cookie: "beta", Role: "tester"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.override.isMatch(req, consumer); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.override, got, tt.want)
+		}
+	}
+}
+
+func TestTrafficSplitPick(t *testing.T) {
+	tests := []struct {
+		weights []int
+		min     []int // the least number of picks of each service in 1000 requests
+		max     []int
+	}{
+		{[]int{100, 0}, []int{1000, 0}, []int{1000, 0}},
+		{[]int{0, 100}, []int{0, 1000}, []int{0, 1000}},
+		{[]int{90, 10}, []int{850, 50}, []int{950, 150}},
+		{[]int{50, 30, 20}, []int{420, 230, 140}, []int{580, 370, 260}},
+	}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	for _, tt := range tests {
+		split := &trafficSplit{}
+		for i, weight := range tt.weights {
+			split.Services = append(split.Services, &splitService{Service: fmt.Sprintf("s%d", i), Weight: weight})
+		}
+		counts := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			counts[split.pick(req, Consumer{}, "10.0.0.1")]++
+		}
+		for i := range tt.weights {
+			count := counts[fmt.Sprintf("s%d", i)]
+			if count < tt.min[i] || count > tt.max[i] {
+				t.Errorf("weights %v: s%d was picked %d times, want between %d and %d", tt.weights, i, count, tt.min[i], tt.max[i])
+			}
+		}
+	}
+}
+
+func TestTrafficSplitPickSticky(t *testing.T) {
+	split := &trafficSplit{
+		Services:  []*splitService{{"stable", 50}, {"canary", 50}},
+		Overrides: []*splitOverride{{Header: "X-Canary", Service: "canary"}},
+		Sticky:    true,
+	}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+
+	// the same consumer or client ip always gets the same service
+	counts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		consumer := Consumer{ID: fmt.Sprintf("c%d", i)}
+		clientIP := fmt.Sprintf("10.0.0.%d", i)
+		first := split.pick(req, consumer, clientIP)
+		counts[first]++
+		tests := []struct {
+			consumer Consumer
+			clientIP string
+		}{
+			{consumer, clientIP},
+			{consumer, "10.1.0.1"},
+		}
+		for _, tt := range tests {
+			if got := split.pick(req, tt.consumer, tt.clientIP); got != first {
+				t.Fatalf("consumer %s from %s: got %s, want %s", tt.consumer.ID, tt.clientIP, got, first)
+			}
+		}
+		if got, want := split.pick(req, Consumer{}, clientIP), split.pick(req, Consumer{}, clientIP); got != want {
+			t.Fatalf("anonymous from %s: got %s, then %s", clientIP, got, want)
+		}
+	}
+	if counts["stable"] < 60 || counts["canary"] < 60 {
+		t.Errorf("sticky keys aren't spread by weights: %v", counts)
+	}
+
+	// overrides win over sticky
+	req.Header.Set("X-Canary", "1")
+	for i := 0; i < 20; i++ {
+		if got := split.pick(req, Consumer{ID: fmt.Sprintf("c%d", i)}, ""); got != "canary" {
+			t.Fatalf("got %s, want canary", got)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// isUpgradeRequest reports whether the client asks to switch protocol, e.g. websocket.
+func isUpgradeRequest(req *http.Request) bool {
+	if len(req.Header.Get("Upgrade")) == 0 {
+		return false
+	}
+	for _, val := range req.Header["Connection"] {
+		for _, token := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newGzipMiddleware compresses the responses like napnap's gzip middleware, but it skips every request with
+// Upgrade header because the connection is hijacked, and the writer of gzip can't be hijacked.
+func newGzipMiddleware(level int) napnap.MiddlewareFunc {
+	gzip := napnap.NewGzip(level)
+	return func(c *napnap.Context, next napnap.HandlerFunc) {
+		if len(c.Request.Header.Get("Upgrade")) > 0 {
+			next(c)
+			return
+		}
+		gzip.Invoke(c, next)
+	}
+}
+
+// dialUpstream opens a raw connection to the upstream of the request.
+func dialUpstream(outReq *http.Request, timeouts TimeoutSetting) (net.Conn, error) {
+	host := outReq.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if outReq.URL.Scheme == "https" {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   timeoutDuration(timeouts.ConnectTimeout),
+		KeepAlive: time.Duration(30) * time.Second,
+	}
+	if outReq.URL.Scheme == "https" {
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: outReq.URL.Hostname()})
+	}
+	return dialer.Dial("tcp", host)
+}
+
+// serveUpgrade sends the upgrade request to upstream and, when upstream agrees to switch protocol,
+// hijacks the client connection and splices both connections together.  Response header rules of api entry
+// are applied to the response of upstream, including the switching protocols one.
+func (p *proxy) serveUpgrade(c *napnap.Context, route *routeMatch, consumer Consumer, outReq *http.Request, timeouts TimeoutSetting) {
+	upgrade := c.Request.Header.Get("Upgrade")
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", upgrade)
+
+	upstreamConn, err := dialUpstream(outReq, timeouts)
+	if err != nil {
+		_logger.debugf("upgrade dial failed: %v", err)
+		c.SetStatus(502)
+		return
+	}
+	defer upstreamConn.Close()
+
+	err = outReq.Write(upstreamConn)
+	if err != nil {
+		_logger.debugf("upgrade request failed: %v", err)
+		c.SetStatus(502)
+		return
+	}
+
+	upstreamReader := bufio.NewReader(upstreamConn)
+	resp, err := http.ReadResponse(upstreamReader, outReq)
+	if err != nil {
+		_logger.debugf("upgrade response failed: %v", err)
+		c.SetStatus(502)
+		return
+	}
+	if route.api.Headers != nil {
+		route.api.Headers.Response.apply(resp.Header, newTemplateVars(c, consumer, route))
+	}
+
+	// upstream refused to switch protocol, so we return its response as usual
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer respClose(resp.Body)
+		p.removeHeader(resp.Header)
+		p.copyHeader(c.Writer.Header(), resp.Header)
+		c.SetStatus(resp.StatusCode)
+		p.copyResponse(c.Writer, resp.Body, nil)
+		return
+	}
+
+	hijacker, ok := c.Writer.(http.Hijacker)
+	if !ok {
+		_logger.debug("response writer doesn't support hijack")
+		c.SetStatus(500)
+		return
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer clientConn.Close()
+	c.Set("status_code", resp.StatusCode)
+	c.Set("upgrade", upgrade)
+
+	// write the switching protocols response back to client
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	err = clientBuf.Flush()
+	if err != nil {
+		_logger.debugf("upgrade response write failed: %v", err)
+		return
+	}
+
+	// splice the connections; the data already buffered on either side must be sent first
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstreamConn, clientBuf.Reader)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(clientConn, upstreamReader)
+		errc <- err
+	}()
+	err = <-errc
+	if err != nil {
+		_logger.debugf("upgrade connection closed: %v", err)
+	}
+}
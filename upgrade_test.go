@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}}, true},
+		{http.Header{"Upgrade": {"websocket"}, "Connection": {"keep-alive, upgrade"}}, true},
+		{http.Header{"Upgrade": {"h2c"}, "Connection": {"HTTP2-Settings", "Upgrade"}}, true},
+		{http.Header{"Upgrade": {"websocket"}}, false},
+		{http.Header{"Connection": {"Upgrade"}}, false},
+		{http.Header{"Upgrade": {"websocket"}, "Connection": {"keep-alive"}}, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header = tt.header
+		if got := isUpgradeRequest(req); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// newEchoUpgradeServer switches to the echo protocol and sends back every line it reads, the requests without
+// the token header are refused.
+func newEchoUpgradeServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" || len(r.Header.Get("X-Token")) == 0 {
+			w.WriteHeader(400)
+			io.WriteString(w, "upgrade was refused")
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		for {
+			line, err := buf.ReadString('\n')
+			if err != nil {
+				return
+			}
+			buf.WriteString("echo: " + line)
+			buf.Flush()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	echo := newEchoUpgradeServer(t)
+	_config = newConfiguration()
+	_config.Gzip.Enable = true
+	setupTestRoutes(t, []*service{
+		{ID: "s1", Name: "echo", Upstreams: []*upstream{{Name: "u1", TargetURL: echo.URL}}},
+	}, []*api{
+		{Name: "echo", RequestHost: "*", RequestPath: "/echo", Service: "echo",
+			Headers: &headerTransform{Response: &headerRules{Set: map[string]string{"X-Gateway": "bifrost"}}}},
+	})
+	tokenMiddleware := func(c *napnap.Context, next napnap.HandlerFunc) {
+		if len(c.Request.Header.Get("Authorization")) > 0 {
+			c.Set("token", "t1")
+		}
+		next(c)
+	}
+	gateway := newTestGateway(t, Consumer{}, newGzipMiddleware(napnap.DefaultCompression), tokenMiddleware, newProxy().Invoke)
+
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(gateway.URL, "http://"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// the upstream refuses the upgrade, the response is returned as usual
+	io.WriteString(conn, "GET /echo HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\nAccept-Encoding: gzip\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 400 || string(body) != "upgrade was refused" || resp.Header.Get("X-Gateway") != "bifrost" {
+		t.Fatalf("got %d %q with headers %v, want the refused response", resp.StatusCode, body, resp.Header)
+	}
+
+	// the connection is spliced after the upstream switched protocol
+	io.WriteString(conn, "GET /echo HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\nAuthorization: Bearer t1\r\nAccept-Encoding: gzip\r\n\r\n")
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Upgrade") != "echo" || resp.Header.Get("X-Gateway") != "bifrost" {
+		t.Fatalf("got %d with headers %v, want 101 with the header rules", resp.StatusCode, resp.Header)
+	}
+	for _, message := range []string{"hello\n", "world\n"} {
+		io.WriteString(conn, message)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "echo: "+message {
+			t.Errorf("got %q, want the echo of %q", line, message)
+		}
+	}
+}
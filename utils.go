@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
+	"net"
+	"strings"
 )
 
 func respClose(body io.ReadCloser) error {
@@ -30,9 +33,41 @@ func panicIf(err error) {
 	}
 }
 
-func getClientIP(ip string) string {
-	if len(ip) > 0 && ip == "::1" {
-		return "127.0.0.1"
+// parseIPNets parses ip addresses and CIDR blocks, an ip address is treated as a single address block.
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	result := []*net.IPNet{}
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("invalid ip address: " + item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// containsIP reports whether ip is in one of the blocks.
+func containsIP(ipNets []*net.IPNet, ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
 	}
-	return ip
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
 }